@@ -0,0 +1,171 @@
+package kademlia
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// AddressPreference says which address family is dialed when a contact can be reached over both
+type AddressPreference int
+
+const (
+	PreferIPv4 AddressPreference = iota // dial IPv4 when possible, the default
+	PreferIPv6                          // dial IPv6 when possible
+	OnlyIPv4                            // never dial IPv6
+	OnlyIPv6                            // never dial IPv4
+)
+
+var ErrNoAddress = errors.New("ADDRESS ERROR: contact has no address of an allowed family")
+
+// names of the preferences, as used by ParseAddressPreference
+var addressPreferences = map[string]AddressPreference{
+	"ipv4":      PreferIPv4,
+	"ipv6":      PreferIPv6,
+	"only-ipv4": OnlyIPv4,
+	"only-ipv6": OnlyIPv6,
+}
+
+// ParseAddressPreference returns the preference called name, which is one of
+// ipv4, ipv6, only-ipv4 and only-ipv6
+func ParseAddressPreference(name string) (AddressPreference, error) {
+	preference, ok := addressPreferences[name]
+	if !ok {
+		return PreferIPv4, fmt.Errorf("ADDRESS ERROR: unknown address preference %q", name)
+	}
+	return preference, nil
+}
+
+// SetAddressPreference makes the messengers of network dial the given family, call it before Start
+func (network *Network) SetAddressPreference(preference AddressPreference) {
+	messenger := network.Messenger
+	if secure, ok := messenger.(*SecureMessenger); ok {
+		messenger = secure.Messenger
+	}
+
+	switch m := messenger.(type) {
+	case *UDPMessenger:
+		m.Prefer = preference
+		if m.TCP != nil {
+			m.TCP.Prefer = preference
+		}
+	case *TCPMessenger:
+		m.Prefer = preference
+	}
+}
+
+// the family of the IP in address, ok is false for hostnames and malformed addresses
+func addressFamily(address string) (ipv6 bool, ok bool) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false, false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false, false
+	}
+	return ip.To4() == nil, true
+}
+
+// DialAddress returns the address of contact that messages are sent to. Addresses of the preferred
+// family come first, then hostnames, then the other family. Address is tried before AltAddress, so
+// the address a contact was observed at wins over what it advertised.
+func (contact *Contact) DialAddress(preference AddressPreference) (string, error) {
+	best, bestRank := "", 3
+	for _, address := range contact.AllAddresses() {
+		rank := 1 // hostname, the resolver picks the family
+		if ipv6, ok := addressFamily(address); ok {
+			preferred := ipv6 == (preference == PreferIPv6 || preference == OnlyIPv6)
+			switch {
+			case preferred:
+				rank = 0
+			case preference == OnlyIPv4 || preference == OnlyIPv6:
+				continue
+			default:
+				rank = 2
+			}
+		}
+		if rank < bestRank {
+			best, bestRank = address, rank
+		}
+	}
+
+	if best == "" {
+		return "", ErrNoAddress
+	}
+	return best, nil
+}
+
+// AllAddresses returns every address of contact, Address first
+func (contact *Contact) AllAddresses() []string {
+	var addresses []string
+	if contact.Address != "" {
+		addresses = append(addresses, contact.Address)
+	}
+	if contact.AltAddress != "" && contact.AltAddress != contact.Address {
+		addresses = append(addresses, contact.AltAddress)
+	}
+	return addresses
+}
+
+// set address as the address of contact for its family. Address is replaced if it has the same
+// family or is not an IP address at all, otherwise AltAddress is.
+func (contact *Contact) setAddress(address string) {
+	ipv6, ok := addressFamily(address)
+	if current, currentOk := addressFamily(contact.Address); contact.Address == "" || !ok || !currentOk || current == ipv6 {
+		contact.Address = address
+		return
+	}
+	contact.AltAddress = address
+}
+
+// the address of contact in the given family, empty if it has none
+func (contact *Contact) addressOfFamily(ipv6 bool) string {
+	for _, address := range contact.AllAddresses() {
+		if family, ok := addressFamily(address); ok && family == ipv6 {
+			return address
+		}
+	}
+	return ""
+}
+
+// LocalIP guesses the IP of this node from the addresses of its network interfaces, without
+// contacting anything. The guess is corrected once peers report the address they see, so it
+// only matters until the node has been in touch with a few peers.
+func LocalIP() net.IP {
+	if ips := LocalIPs(); len(ips) > 0 {
+		return ips[0]
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// LocalIPs returns a global IP of each address family this node has, IPv4 first
+func LocalIPs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	var ipv4, ipv6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			if ipv4 == nil {
+				ipv4 = ipNet.IP
+			}
+		} else if ipv6 == nil {
+			ipv6 = ipNet.IP
+		}
+	}
+
+	var ips []net.IP
+	for _, ip := range []net.IP{ipv4, ipv6} {
+		if ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
@@ -0,0 +1,189 @@
+package kademlia
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// skip the test if this host can not listen on the IPv6 loopback
+func requireIPv6(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 is not available: %s", err)
+	}
+	conn.Close()
+}
+
+// a node that advertises the given addresses, with the port it listens on
+func newAddressTestNode(t *testing.T, address string, altHost string) *Kademlia {
+	me := NewContact(NewRandomKademliaID(), address)
+	if altHost != "" {
+		me.AltAddress = net.JoinHostPort(altHost, "0")
+	}
+	node := newTestKademlia(t, me)
+	if err := node.Start(); err != nil {
+		t.Fatalf("Could not start node: %s", err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+func TestDialAddress(t *testing.T) {
+	dualStack := Contact{Address: "127.0.0.1:1234", AltAddress: "[::1]:1234"}
+	ipv4 := Contact{Address: "127.0.0.1:1234"}
+	hostname := Contact{Address: "localhost:1234", AltAddress: "[::1]:1234"}
+
+	tests := []struct {
+		contact    Contact
+		preference AddressPreference
+		expected   string
+	}{
+		{dualStack, PreferIPv4, "127.0.0.1:1234"},
+		{dualStack, PreferIPv6, "[::1]:1234"},
+		{dualStack, OnlyIPv4, "127.0.0.1:1234"},
+		{dualStack, OnlyIPv6, "[::1]:1234"},
+		{ipv4, PreferIPv6, "127.0.0.1:1234"},     // the other family is better than nothing
+		{hostname, PreferIPv4, "localhost:1234"}, // the resolver may still find IPv4
+		{hostname, OnlyIPv6, "[::1]:1234"},
+	}
+	for _, test := range tests {
+		if address, err := test.contact.DialAddress(test.preference); err != nil || address != test.expected {
+			t.Fatalf("Dialed %s instead of %s for %v! %v", address, test.expected, test.contact, err)
+		}
+	}
+
+	// test that a contact without an allowed address can not be dialed
+	if _, err := ipv4.DialAddress(OnlyIPv6); err != ErrNoAddress {
+		t.Fatalf("An IPv4 contact was dialed over IPv6! %v", err)
+	}
+	if _, err := (&Contact{}).DialAddress(PreferIPv4); err != ErrNoAddress {
+		t.Fatalf("A contact without address was dialed! %v", err)
+	}
+}
+
+func TestSetAddress(t *testing.T) {
+	contact := NewContact(NewRandomKademliaID(), "127.0.0.1:1234")
+
+	// test that an address of the other family is added, not replaced
+	contact.setAddress("[::1]:1234")
+	if contact.Address != "127.0.0.1:1234" || contact.AltAddress != "[::1]:1234" {
+		t.Fatalf("The IPv6 address replaced the IPv4 address! %s %s", contact.Address, contact.AltAddress)
+	}
+
+	// test that addresses of the same family are replaced
+	contact.setAddress("192.0.2.1:1234")
+	contact.setAddress("[2001:db8::1]:1234")
+	if contact.Address != "192.0.2.1:1234" || contact.AltAddress != "[2001:db8::1]:1234" {
+		t.Fatalf("The addresses were not replaced! %s %s", contact.Address, contact.AltAddress)
+	}
+	if contact.addressOfFamily(true) != "[2001:db8::1]:1234" || contact.addressOfFamily(false) != "192.0.2.1:1234" {
+		t.Fatalf("The address of each family was not found!")
+	}
+
+	if preference, err := ParseAddressPreference("only-ipv6"); err != nil || preference != OnlyIPv6 {
+		t.Fatalf("The preference was not parsed! %v", err)
+	}
+	if _, err := ParseAddressPreference("ipv5"); err == nil {
+		t.Fatalf("An unknown preference was parsed!")
+	}
+}
+
+func TestBinaryCodecAltAddress(t *testing.T) {
+	msg := codecTestMessage()
+	msg.Sender.AltAddress = "[2001:db8::1]:1234"
+	msg.Contacts[1].AltAddress = "[2001:db8::2]:1234"
+
+	data, _ := BinaryCodec{}.Encode(msg)
+	decoded, err := BinaryCodec{}.Decode(data)
+	if err != nil || decoded.Sender.AltAddress != msg.Sender.AltAddress || decoded.Contacts[1].AltAddress != msg.Contacts[1].AltAddress || decoded.Contacts[0].AltAddress != "" {
+		t.Fatalf("The other addresses were not sent! %+v %v", decoded, err)
+	}
+}
+
+func TestPingOverIPv6(t *testing.T) {
+	requireIPv6(t)
+	a := newAddressTestNode(t, "[::1]:0", "")
+	b := newAddressTestNode(t, "[::1]:0", "")
+
+	// test that the picked port was advertised in the IPv6 address
+	if host, port, err := net.SplitHostPort(b.Rt.Me().Address); err != nil || host != "::1" || port != b.Network.ListenPort {
+		t.Fatalf("The IPv6 address does not have the listen port! %s", b.Rt.Me().Address)
+	}
+
+	bContact := b.Rt.Me()
+	if res, err := a.Network.PingContext(context.Background(), &bContact); err != nil || res.MsgType != "PONG" {
+		t.Fatalf("The ping over IPv6 was not answered! %v", err)
+	}
+
+	// test that b knows a by its IPv6 address
+	time.Sleep(10 * time.Millisecond)
+	if closest := b.Rt.FindClosestContacts(a.Rt.Me().ID, 1); len(closest) != 1 || closest[0].Address != a.Rt.Me().Address {
+		t.Fatalf("The IPv6 sender was not added with its address! %v", closest)
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	requireIPv6(t)
+	a := newAddressTestNode(t, "127.0.0.1:0", "::1")
+	b := newAddressTestNode(t, "127.0.0.1:0", "::1")
+	a.Network.SetAddressPreference(PreferIPv6) // a still answers b over IPv4
+
+	// test that the picked port was advertised in both families
+	me := b.Rt.Me()
+	if me.AltAddress != net.JoinHostPort("::1", b.Network.ListenPort) {
+		t.Fatalf("The IPv6 address does not have the listen port! %s %s", me.Address, me.AltAddress)
+	}
+
+	// test that a node listening once can be reached over both families
+	if res, err := a.Network.PingContext(context.Background(), &me); err != nil || res.MsgType != "PONG" {
+		t.Fatalf("The dual stack node was not reached over IPv6! %v", err)
+	}
+
+	// test that b saw a at its IPv6 address and kept the IPv4 address it advertised once it answered a ping
+	var closest []Contact
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		closest = b.Rt.FindClosestContacts(a.Rt.Me().ID, 1)
+		if len(closest) == 1 && closest[0].addressOfFamily(false) == a.Rt.Me().Address && closest[0].addressOfFamily(true) == a.Rt.Me().AltAddress {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("The addresses of the dual stack sender were not kept! %v", closest)
+		}
+	}
+
+	// test that b reaches a over IPv4, and accepts the response a sends over IPv6
+	if res, err := b.Network.PingContext(context.Background(), &closest[0]); err != nil || res.MsgType != "PONG" {
+		t.Fatalf("The dual stack node was not reached over IPv4! %v", err)
+	}
+}
+
+func TestRecordObservedPerFamily(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "10.0.0.5:4000")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "4000",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	response := func(peer string, observed string) Message {
+		return Message{MsgType: "PONG", Sender: NewContact(NewRandomKademliaID(), peer), Observed: observed}
+	}
+
+	// IPv6 peers outnumber the IPv4 peers, but only vote on the IPv6 address
+	n.recordObserved(response("[2001:db8::a]:1234", "[2001:db8::5]:1234"))
+	n.recordObserved(response("[2001:db8::b]:1234", "[2001:db8::5]:1234"))
+	n.recordObserved(response("[2001:db8::c]:1234", "[2001:db8::5]:1234"))
+	n.recordObserved(response("10.0.0.1:1234", "192.0.2.1:1234"))
+	n.recordObserved(response("10.0.0.2:1234", "192.0.2.1:1234"))
+
+	if address := rt.Me(); address.Address != "192.0.2.1:4000" || address.AltAddress != "[2001:db8::5]:4000" {
+		t.Fatalf("The addresses were not voted on per family! %s %s", address.Address, address.AltAddress)
+	}
+}
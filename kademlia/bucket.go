@@ -2,51 +2,129 @@ package kademlia
 
 import (
 	"container/list"
+	"time"
 )
 
 // bucket definition
 // contains a List
 type bucket struct {
-	list *list.List
+	list         *list.List
+	replacements *list.List // contacts seen while the bucket was full, the freshest first
+	size         int        // contacts the bucket and its replacement cache hold at most
+	lastLookup   time.Time  // when a lookup in the range of the bucket was last started
+	checking     bool       // the oldest contact is being pinged, see RoutingTable.AddContact
 }
 
-// newBucket returns a new instance of a bucket
-func newBucket() *bucket {
-	bucket := &bucket{}
+// newBucket returns a new instance of a bucket that holds size contacts
+func newBucket(size int) *bucket {
+	bucket := &bucket{size: size, lastLookup: time.Now()}
 	bucket.list = list.New()
+	bucket.replacements = list.New()
 	return bucket
 }
 
 // AddContact adds the Contact to the front of the bucket
-// or moves it to the front of the bucket if it already existed
+// or moves it to the front of the bucket if it already existed, keeping its address.
+// If the bucket is full the oldest contact is pinged, and replaced by contact if it does not respond.
 func (bucket *bucket) AddContact(contact Contact, ping func(*Contact, chan Message)) {
-	var element *list.Element
-	for e := bucket.list.Front(); e != nil; e = e.Next() { // check if the contact is in the bucket
-		nodeID := e.Value.(Contact).ID
+	oldest, full := bucket.insert(contact, false)
+	if full {
+		responseCh := make(chan Message)
+		go ping(&oldest, responseCh)
+		bucket.checked(oldest, <-responseCh)
+	}
+}
 
-		if (contact).ID.Equals(nodeID) {
-			element = e
+// insert contact without waiting for the network. If the bucket is full contact becomes the freshest
+// candidate of the replacement cache, and the oldest contact is returned to be checked with a ping.
+// A known contact only takes the address of contact if moved, see RoutingTable.AddSender.
+func (bucket *bucket) insert(contact Contact, moved bool) (Contact, bool) {
+	if element := findElement(bucket.list, contact.ID); element != nil { // if contact is in bucket
+		if moved {
+			element.Value = contact
 		}
+		bucket.list.MoveToFront(element)
+		return Contact{}, false
 	}
-	if element == nil { // if contact not in bucket
-		if bucket.list.Len() < bucketSize { // and bucket not full
-			bucket.list.PushFront(contact) // add new contact to head
-		} else { // if bucket is full and contact not in bucket
-			oldestElement := bucket.list.Back()
-			oldest := oldestElement.Value.(Contact)
-			responseCh := make(chan Message)
-			go ping(&oldest, responseCh)
-			response := <-responseCh
-			if response.MsgType == "TIMEOUT" { // if oldest node fails to respond
-				bucket.list.Remove(oldestElement) // remove it
-				bucket.list.PushFront(contact)
-			} else {
-				bucket.list.MoveToFront(oldestElement)
-			}
-		}
-	} else { // if contact is in bucket
+	if bucket.list.Len() < bucket.size { // if bucket not full
+		bucket.list.PushFront(contact) // add new contact to head
+		bucket.removeReplacement(contact.ID)
+		return Contact{}, false
+	}
+	bucket.addReplacement(contact, moved) // wait for a place in the bucket
+	return bucket.list.Back().Value.(Contact), true
+}
+
+// apply the response of the oldest contact to the ping of insert. A contact that did not respond is
+// replaced by the freshest candidate, unless it was seen again while the ping was sent. Returns
+// whether the oldest contact was evicted.
+func (bucket *bucket) checked(oldest Contact, response Message) bool {
+	element := findElement(bucket.list, oldest.ID)
+	if element == nil { // replaced while the ping was sent
+		return false
+	}
+	if response.MsgType != "TIMEOUT" {
 		bucket.list.MoveToFront(element)
+	} else if element == bucket.list.Back() {
+		_, evicted := bucket.replaceFailed(oldest.ID)
+		return evicted
 	}
+	return false
+}
+
+// remember contact as a candidate for the bucket, the oldest candidate is dropped when the cache is full.
+// A known candidate only takes the address of contact if moved.
+func (bucket *bucket) addReplacement(contact Contact, moved bool) {
+	if element := findElement(bucket.replacements, contact.ID); element != nil {
+		if moved {
+			element.Value = contact
+		}
+		bucket.replacements.MoveToFront(element)
+		return
+	}
+	bucket.replacements.PushFront(contact)
+	if bucket.replacements.Len() > bucket.size {
+		bucket.replacements.Remove(bucket.replacements.Back())
+	}
+}
+
+// forget the candidate with id, it is in the bucket now
+func (bucket *bucket) removeReplacement(id *KademliaID) {
+	if element := findElement(bucket.replacements, id); element != nil {
+		bucket.replacements.Remove(element)
+	}
+}
+
+// replace the contact with id by the freshest candidate. A failed contact is kept if there is
+// no candidate, it may come back and is better than an empty slot. Returns the promoted candidate.
+func (bucket *bucket) replaceFailed(id *KademliaID) (Contact, bool) {
+	element := findElement(bucket.list, id)
+	if element == nil || bucket.replacements.Len() == 0 {
+		return Contact{}, false
+	}
+	candidate := bucket.replacements.Remove(bucket.replacements.Front()).(Contact)
+	bucket.list.Remove(element)
+	bucket.list.PushFront(candidate)
+	return candidate, true
+}
+
+// the element of l that holds the contact with id, nil if there is none
+func findElement(l *list.List, id *KademliaID) *list.Element {
+	for e := l.Front(); e != nil; e = e.Next() {
+		if id.Equals(e.Value.(Contact).ID) {
+			return e
+		}
+	}
+	return nil
+}
+
+// contacts of l in order
+func listContacts(l *list.List) []Contact {
+	contacts := make([]Contact, 0, l.Len())
+	for e := l.Front(); e != nil; e = e.Next() {
+		contacts = append(contacts, e.Value.(Contact))
+	}
+	return contacts
 }
 
 // GetContactAndCalcDistance returns an array of Contacts where
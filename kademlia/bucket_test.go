@@ -20,14 +20,14 @@ var pingTestTimeout = func(_ *Contact, out chan Message) {
 }
 
 func TestNewBucket(t *testing.T) {
-	var lBucket = newBucket()
+	var lBucket = newBucket(DefaultK)
 	var lBucketType interface{} = lBucket
 
 	// test if func return a bucket
 	_, ok := lBucketType.(*bucket)
 
 	if !ok {
-		t.Fatalf("newBucket() does not return bucket of type 'bucket'")
+		t.Fatalf("newBucket(DefaultK) does not return bucket of type 'bucket'")
 	}
 
 	// test if bucket is empty
@@ -46,7 +46,7 @@ func TestAddContact(t *testing.T) {
 		}
 	}
 
-	var lBucket = newBucket()
+	var lBucket = newBucket(DefaultK)
 
 	// add element to bucket and check that it can be found in the front
 	id := NewKademliaID("FFFFFFFF00000000000000000000000000000000")
@@ -63,14 +63,14 @@ func TestAddContact(t *testing.T) {
 
 	// check that a new element can not be added to bucket if bucket is already full
 	var s, _ = hex.DecodeString("FFFFFFFFFFFFFFFF000000000000000000000000")
-	for i := 0; i < bucketSize-2; i++ {
+	for i := 0; i < DefaultK-2; i++ {
 		s[0] -= 1
 		contact = NewContact(NewKademliaID(hex.EncodeToString(s)), "localhost:8000")
 		lBucket.AddContact(contact, pingTest)
 	}
 
 	var l = lBucket.Len()
-	if l != bucketSize {
+	if l != DefaultK {
 		t.Fatalf("The bucket is not full! It only contains %d elements.", l)
 	}
 
@@ -82,7 +82,7 @@ func TestAddContact(t *testing.T) {
 }
 
 func TestGetContactAndCalcDistance(t *testing.T) {
-	var lBucket = newBucket()
+	var lBucket = newBucket(DefaultK)
 
 	lBucket.AddContact(NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "localhost:8000"), pingTest)
 	lBucket.AddContact(NewContact(NewKademliaID("2FFFFFFF00000000000000000000000000000000"), "localhost:8000"), pingTest)
@@ -99,7 +99,7 @@ func TestGetContactAndCalcDistance(t *testing.T) {
 }
 
 func TestLen(t *testing.T) {
-	var lBucket = newBucket()
+	var lBucket = newBucket(DefaultK)
 
 	lBucket.AddContact(NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "localhost:8000"), pingTest)
 	lBucket.AddContact(NewContact(NewKademliaID("2FFFFFFF00000000000000000000000000000000"), "localhost:8000"), pingTest)
@@ -111,3 +111,82 @@ func TestLen(t *testing.T) {
 		t.Fatalf("The returned length is incorrect. lBucket.len() = %d != 3", bucketLen)
 	}
 }
+
+func TestAddContactUpdatesAddress(t *testing.T) {
+	var lBucket = newBucket(DefaultK)
+	id := NewKademliaID("FFFFFFFF00000000000000000000000000000000")
+
+	// add a contact and then the same contact on another port, as another node could tell about it
+	lBucket.AddContact(NewContact(id, "127.0.0.1:8000"), pingTest)
+	lBucket.AddContact(NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "127.0.0.1:8001"), pingTest)
+	lBucket.AddContact(NewContact(id, "127.0.0.1:8002"), pingTest)
+
+	if lBucket.Len() != 2 {
+		t.Fatalf("The moved contact was added twice! %d != 2", lBucket.Len())
+	}
+	if front := lBucket.list.Front().Value.(Contact); *front.ID != *id || front.Address != "127.0.0.1:8000" {
+		t.Fatalf("The contact was not refreshed, or its address was changed by another node! %v", front)
+	}
+
+	// test that the address is updated when the contact itself sent a message from there
+	lBucket.insert(NewContact(id, "127.0.0.1:8002"), true)
+	if address := lBucket.list.Front().Value.(Contact).Address; address != "127.0.0.1:8002" {
+		t.Fatalf("The address of the contact was not updated! %s", address)
+	}
+}
+
+func TestReplacementCache(t *testing.T) {
+	var lBucket = newBucket(2)
+	var contacts []Contact
+	for i := 0; i < 5; i++ {
+		contacts = append(contacts, NewContact(NewRandomKademliaID(), "localhost:8000"))
+	}
+
+	// the bucket is full after two contacts, the newcomers are cached while the oldest responds
+	for _, contact := range contacts {
+		lBucket.AddContact(contact, pingTest)
+	}
+	replacements := listContacts(lBucket.replacements)
+	if lBucket.Len() != 2 || len(replacements) != 2 {
+		t.Fatalf("The replacement cache is not bounded! %d %d", lBucket.Len(), len(replacements))
+	}
+	if *replacements[0].ID != *contacts[4].ID || *replacements[1].ID != *contacts[3].ID {
+		t.Fatalf("The freshest candidates were not kept first! %v", replacements)
+	}
+
+	// test that a candidate seen again becomes the freshest
+	lBucket.AddContact(contacts[3], pingTest)
+	if front := lBucket.replacements.Front().Value.(Contact); *front.ID != *contacts[3].ID {
+		t.Fatalf("The candidate seen again is not the freshest! %v", front)
+	}
+
+	// test that a failed contact is replaced by the freshest candidate
+	promoted, ok := lBucket.replaceFailed(contacts[0].ID)
+	if !ok || *promoted.ID != *contacts[3].ID || findElement(lBucket.list, contacts[0].ID) != nil || findElement(lBucket.list, contacts[3].ID) == nil {
+		t.Fatalf("The failed contact was not replaced by the freshest candidate! %v", promoted)
+	}
+	if _, ok := lBucket.replaceFailed(contacts[2].ID); ok {
+		t.Fatalf("A contact that is not in the bucket was replaced!")
+	}
+
+	// test that a failed contact is kept without candidates
+	lBucket.replaceFailed(contacts[1].ID)
+	if _, ok := lBucket.replaceFailed(contacts[4].ID); ok || lBucket.Len() != 2 {
+		t.Fatalf("A contact was replaced without a candidate!")
+	}
+}
+
+func TestReplacementAddedToBucket(t *testing.T) {
+	var lBucket = newBucket(1)
+	first := NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "localhost:8000")
+	second := NewContact(NewKademliaID("2FFFFFFF00000000000000000000000000000000"), "localhost:8000")
+
+	lBucket.AddContact(first, pingTest)
+	lBucket.AddContact(second, pingTest)
+
+	// test that a candidate that takes the place of a contact that timed out is no longer cached
+	lBucket.AddContact(second, pingTestTimeout)
+	if *lBucket.list.Front().Value.(Contact).ID != *second.ID || lBucket.replacements.Len() != 0 {
+		t.Fatalf("The candidate is still cached after it was added! %d", lBucket.replacements.Len())
+	}
+}
@@ -2,8 +2,10 @@ package kademlia
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 )
@@ -103,10 +105,13 @@ func (cli *cli) HandleInput(command, input string) error {
 	return nil
 }
 
-// Stores the input by calling the "Store" function in kademlia
+// Stores the input by calling the "Store" function in kademlia. Can be aborted with Ctrl+C.
 func (cli *cli) Put(input string) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	data := []byte(input)
-	err, hash := cli.Kademlia.Store(data)
+	err, hash := cli.Kademlia.StoreContext(ctx, data)
 
 	if err != nil { // print of result should maybe not be here
 		fmt.Println("An error occured:", err)
@@ -115,28 +120,40 @@ func (cli *cli) Put(input string) {
 	}
 }
 
-// Tries to get the data corresponding to the hash.
+// Tries to get the data corresponding to the hash. Can be aborted with Ctrl+C.
 func (cli *cli) Get(hash string) {
-	fmt.Println(cli.Kademlia.LookupData(hash)) // print of result should maybe not be here
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	res, err := cli.Kademlia.LookupDataContext(ctx, hash)
+	if err != nil { // print of result should maybe not be here
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(res)
 }
 
 // Shows the nodes routing table
 func (cli *cli) Show() string {
 	rtInfo := "Routing table:\n"
 
-	currRt := cli.Kademlia.Rt.buckets
-
-	for i, val := range currRt {
-		rtInfo += "Content in bucket " + strconv.Itoa(i) + "\n"
-		for e := val.list.Front(); e != nil; e = e.Next() {
-			rtInfo += "  " + e.Value.(Contact).ID.String() + "\n"
+	for _, bucket := range cli.Kademlia.Rt.Buckets() {
+		rtInfo += "Content in bucket " + strconv.Itoa(bucket.Index) + "\n"
+		for _, contact := range bucket.Contacts {
+			rtInfo += "  " + contact.ID.String() + "\n"
+		}
+		for _, contact := range bucket.Replacements { // not in the bucket, but next in line
+			rtInfo += "  (replacement) " + contact.ID.String() + "\n"
 		}
 	}
 
 	return rtInfo
 }
 
-// Terminates the node
+// Terminates the node after closing it
 func (cli *cli) Exit() {
+	if err := cli.Kademlia.Close(); err != nil {
+		fmt.Println(err.Error())
+	}
 	os.Exit(0)
 }
@@ -114,7 +114,7 @@ func TestShow(t *testing.T) {
 		contacts = append(contacts, GetContact(detail))
 	}
 
-	k := NewKademlia(contacts[0])
+	k := newTestKademlia(t, contacts[0])
 
 	k.Rt.AddContact(contacts[1], pingTest)
 	k.Rt.AddContact(contacts[2], pingTest)
@@ -0,0 +1,347 @@
+package kademlia
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+)
+
+// Codec turns a Message into the bytes that are sent over the network and back again
+type Codec interface {
+	Encode(msg Message) ([]byte, error)
+	Decode(data []byte) (Message, error)
+}
+
+// BinaryCodec is the default wire format. All integers are big endian.
+//
+//	header:
+//	  magic    2 bytes  0x4B 0x44 ("KD")
+//	  version  1 byte   ProtocolVersion
+//	  type     1 byte   message type, see messageTypes
+//	body:
+//	  RPCID    20 bytes
+//	  Key      20 bytes
+//	  Sender   contact
+//	  Body     4 byte length followed by the bytes of the body
+//	  Contacts 2 byte count followed by that many contacts
+//	  extensions until the end of the packet, each one is a 1 byte tag, a 2 byte length and
+//	  the value. Tags that are not known by the receiver are skipped so fields can be added
+//	  without a new version. Empty extensions are never sent.
+//	extensions:
+//	  1        PublicKey, the ed25519 public key of the sender
+//	  2        Signature, the ed25519 signature of the sender
+//	  3        Observed, the address the request was received from
+//	contact:
+//	  flags    1 byte   bit 0 is set if the contact has an ID, bit 1 if it has a nonce,
+//	           bit 2 if it has an address in the other IP family
+//	  ID       20 bytes, only present if bit 0 of flags is set
+//	  Address  2 byte length followed by the bytes of the address
+//	  Nonce    20 bytes, only present if bit 1 of flags is set
+//	  AltAddress 2 byte length followed by the bytes, only present if bit 2 of flags is set
+//
+// Packets with another magic or version are rejected.
+type BinaryCodec struct{}
+
+// GobCodec is the original wire format, a gob encoding of the Message struct.
+// Kept for compatibility with nodes that do not speak the binary format.
+type GobCodec struct{}
+
+// ProtocolVersion is the version of the binary wire format
+const ProtocolVersion = 1
+
+var binaryMagic = [2]byte{0x4B, 0x44}
+
+const binaryHeaderSize = 4
+
+// message types of the binary wire format, the zero value is never used
+var messageTypes = map[string]byte{
+	"PING":                  1,
+	"PONG":                  2,
+	"FIND_CONTACT":          3,
+	"FIND_CONTACT_RESPONSE": 4,
+	"FIND_DATA":             5,
+	"FIND_DATA_RESPONSE":    6,
+	"STORE":                 7,
+	"STORE_RESPONSE":        8,
+	"HANDSHAKE":             9,
+	"HANDSHAKE_RESPONSE":    10,
+	"SEALED":                11,
+}
+
+// reverse of messageTypes
+var messageTypeNames = func() map[byte]string {
+	names := make(map[byte]string, len(messageTypes))
+	for name, t := range messageTypes {
+		names[t] = name
+	}
+	return names
+}()
+
+const (
+	contactHasID         = 1 << 0
+	contactHasNonce      = 1 << 1
+	contactHasAltAddress = 1 << 2
+)
+
+// extension tags of the binary wire format
+const (
+	extPublicKey = 1
+	extSignature = 2
+	extObserved  = 3
+)
+
+var (
+	ErrBadMagic           = errors.New("CODEC ERROR: packet does not start with the protocol magic")
+	ErrUnsupportedVersion = errors.New("CODEC ERROR: unsupported protocol version")
+	ErrUnknownMessageType = errors.New("CODEC ERROR: unknown message type")
+	ErrTruncated          = errors.New("CODEC ERROR: packet is truncated")
+	ErrFieldTooLarge      = errors.New("CODEC ERROR: field is too large to encode")
+)
+
+// Encode msg in the binary wire format
+func (BinaryCodec) Encode(msg Message) ([]byte, error) {
+	msgType, ok := messageTypes[msg.MsgType]
+	if !ok {
+		return nil, ErrUnknownMessageType
+	}
+	if len(msg.Contacts) > 0xFFFF || uint64(len(msg.Body)) > 0xFFFFFFFF {
+		return nil, ErrFieldTooLarge
+	}
+
+	var buf bytes.Buffer
+	buf.Write(binaryMagic[:])
+	buf.WriteByte(ProtocolVersion)
+	buf.WriteByte(msgType)
+	buf.Write(msg.RPCID[:])
+	buf.Write(msg.Key[:])
+
+	if err := encodeContact(&buf, msg.Sender); err != nil {
+		return nil, err
+	}
+
+	binary.Write(&buf, binary.BigEndian, uint32(len(msg.Body)))
+	buf.WriteString(msg.Body)
+
+	binary.Write(&buf, binary.BigEndian, uint16(len(msg.Contacts)))
+	for _, contact := range msg.Contacts {
+		if err := encodeContact(&buf, contact); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, ext := range []struct {
+		tag   byte
+		value []byte
+	}{
+		{extPublicKey, msg.PublicKey},
+		{extSignature, msg.Signature},
+		{extObserved, []byte(msg.Observed)},
+	} {
+		if err := encodeExtension(&buf, ext.tag, ext.value); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decode a message in the binary wire format
+func (BinaryCodec) Decode(data []byte) (Message, error) {
+	var msg Message
+
+	if len(data) < binaryHeaderSize {
+		return msg, ErrTruncated
+	}
+	if data[0] != binaryMagic[0] || data[1] != binaryMagic[1] {
+		return msg, ErrBadMagic
+	}
+	if data[2] != ProtocolVersion {
+		return msg, ErrUnsupportedVersion
+	}
+
+	msgType, ok := messageTypeNames[data[3]]
+	if !ok {
+		return msg, ErrUnknownMessageType
+	}
+	msg.MsgType = msgType
+
+	r := &reader{data: data[binaryHeaderSize:]}
+	copy(msg.RPCID[:], r.next(IDLength))
+	copy(msg.Key[:], r.next(IDLength))
+	msg.Sender = decodeContact(r)
+	msg.Body = string(r.next(int(r.uint32())))
+
+	count := int(r.uint16())
+	if count > 0 {
+		msg.Contacts = make([]Contact, 0, min(count, len(r.data)))
+	}
+	for i := 0; i < count && r.err == nil; i++ {
+		msg.Contacts = append(msg.Contacts, decodeContact(r))
+	}
+
+	// read extensions, unknown ones are skipped
+	for r.err == nil && len(r.data) > 0 {
+		tag := r.byte()
+		value := r.next(int(r.uint16()))
+		if len(value) == 0 {
+			continue
+		}
+
+		switch tag {
+		case extPublicKey:
+			msg.PublicKey = append([]byte(nil), value...)
+		case extSignature:
+			msg.Signature = append([]byte(nil), value...)
+		case extObserved:
+			msg.Observed = string(value)
+		}
+	}
+
+	if r.err != nil {
+		return Message{}, r.err
+	}
+	return msg, nil
+}
+
+// write an extension to buf, nothing is written if value is empty
+func encodeExtension(buf *bytes.Buffer, tag byte, value []byte) error {
+	if len(value) == 0 {
+		return nil
+	}
+	if len(value) > 0xFFFF {
+		return ErrFieldTooLarge
+	}
+
+	buf.WriteByte(tag)
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.Write(value)
+	return nil
+}
+
+// write contact to buf
+func encodeContact(buf *bytes.Buffer, contact Contact) error {
+	if len(contact.Address) > 0xFFFF || len(contact.AltAddress) > 0xFFFF {
+		return ErrFieldTooLarge
+	}
+
+	var flags byte
+	if contact.ID != nil {
+		flags |= contactHasID
+	}
+	if contact.Nonce != nil {
+		flags |= contactHasNonce
+	}
+	if contact.AltAddress != "" {
+		flags |= contactHasAltAddress
+	}
+	buf.WriteByte(flags)
+	if contact.ID != nil {
+		buf.Write(contact.ID[:])
+	}
+
+	binary.Write(buf, binary.BigEndian, uint16(len(contact.Address)))
+	buf.WriteString(contact.Address)
+
+	if contact.Nonce != nil {
+		buf.Write(contact.Nonce[:])
+	}
+	if contact.AltAddress != "" {
+		binary.Write(buf, binary.BigEndian, uint16(len(contact.AltAddress)))
+		buf.WriteString(contact.AltAddress)
+	}
+	return nil
+}
+
+// read a contact from r
+func decodeContact(r *reader) Contact {
+	var contact Contact
+
+	flags := r.byte()
+	if flags&contactHasID != 0 {
+		contact.ID = &KademliaID{}
+		copy(contact.ID[:], r.next(IDLength))
+	}
+	contact.Address = string(r.next(int(r.uint16())))
+	if flags&contactHasNonce != 0 {
+		contact.Nonce = &KademliaID{}
+		copy(contact.Nonce[:], r.next(IDLength))
+	}
+	if flags&contactHasAltAddress != 0 {
+		contact.AltAddress = string(r.next(int(r.uint16())))
+	}
+
+	return contact
+}
+
+// reader reads fields from a packet, once a read is out of bounds err is set and every read returns zero values
+type reader struct {
+	data []byte
+	err  error
+}
+
+// next returns the next n bytes
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = ErrTruncated
+		r.data = nil
+		return nil
+	}
+	res := r.data[:n]
+	r.data = r.data[n:]
+	return res
+}
+
+func (r *reader) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// Encode msg with gob
+func (GobCodec) Encode(msg Message) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf) // encoded bytes go to buf
+
+	if err := enc.Encode(msg); err != nil { // encode
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode a gob encoded message
+func (GobCodec) Decode(data []byte) (Message, error) {
+	dec := gob.NewDecoder(bytes.NewBuffer(data)) // give message as input to decoder
+	var msg Message
+	err := dec.Decode(&msg) //place the decoded message in msg
+	return msg, err
+}
+
+// returns codec, or the default codec if it is nil
+func codecOrDefault(codec Codec) Codec {
+	if codec == nil {
+		return BinaryCodec{}
+	}
+	return codec
+}
@@ -0,0 +1,151 @@
+package kademlia
+
+import (
+	"reflect"
+	"testing"
+)
+
+// a message that uses every field of the wire format
+func codecTestMessage() Message {
+	return Message{
+		MsgType: "FIND_DATA_RESPONSE",
+		Sender:  NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234"),
+		Body:    "this is the body",
+		Key:     *NewKademliaID("1111111100000000000000000000000000000000"),
+		RPCID:   *NewKademliaID("2222222200000000000000000000000000000000"),
+		Contacts: []Contact{
+			NewContact(NewKademliaID("3333333300000000000000000000000000000000"), "127.0.0.2:1234"),
+			NewContact(NewKademliaID("4444444400000000000000000000000000000000"), "127.0.0.3:1234"),
+		},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{BinaryCodec{}, GobCodec{}} {
+		msg := codecTestMessage()
+
+		data, err := codec.Encode(msg)
+		if err != nil {
+			t.Fatalf("%T could not encode the message: %s", codec, err)
+		}
+
+		res, err := codec.Decode(data)
+		if err != nil {
+			t.Fatalf("%T could not decode the message: %s", codec, err)
+		}
+
+		if !reflect.DeepEqual(msg, res) {
+			t.Fatalf("%T did not decode the same message that was encoded! \n%+v \n%+v", codec, msg, res)
+		}
+	}
+}
+
+func TestBinaryCodecMessageTypes(t *testing.T) {
+	codec := BinaryCodec{}
+
+	// test that every known message type survives the round trip, even without a sender ID
+	for name := range messageTypes {
+		data, err := codec.Encode(Message{MsgType: name, Sender: Contact{Address: "127.0.0.1:1234"}})
+		if err != nil {
+			t.Fatalf("Could not encode message of type %s: %s", name, err)
+		}
+
+		res, err := codec.Decode(data)
+		if err != nil || res.MsgType != name || res.Sender.ID != nil {
+			t.Fatalf("Message of type %s was not decoded correctly! %s", name, err)
+		}
+	}
+
+	// test that messages of unknown types can not be encoded
+	if _, err := codec.Encode(Message{MsgType: "TIMEOUT"}); err != ErrUnknownMessageType {
+		t.Fatalf("A message of an unknown type should not be encoded! %v", err)
+	}
+}
+
+func TestBinaryCodecRejects(t *testing.T) {
+	codec := BinaryCodec{}
+	data, _ := codec.Encode(codecTestMessage())
+
+	// test unknown version
+	wrongVersion := append([]byte(nil), data...)
+	wrongVersion[2] = ProtocolVersion + 1
+	if _, err := codec.Decode(wrongVersion); err != ErrUnsupportedVersion {
+		t.Fatalf("A packet with an unknown version should be rejected! %v", err)
+	}
+
+	// test wrong magic, a gob encoded message should not be mistaken for a binary one
+	gobData, _ := GobCodec{}.Encode(codecTestMessage())
+	if _, err := codec.Decode(gobData); err != ErrBadMagic {
+		t.Fatalf("A packet without the magic should be rejected! %v", err)
+	}
+
+	// test unknown message type
+	wrongType := append([]byte(nil), data...)
+	wrongType[3] = 0
+	if _, err := codec.Decode(wrongType); err != ErrUnknownMessageType {
+		t.Fatalf("A packet with an unknown message type should be rejected! %v", err)
+	}
+
+	// test that every truncation of the packet is rejected
+	for i := 0; i < len(data); i++ {
+		if _, err := codec.Decode(data[:i]); err == nil {
+			t.Fatalf("A packet truncated to %d bytes was accepted!", i)
+		}
+	}
+}
+
+func TestBinaryCodecSkipsExtensions(t *testing.T) {
+	codec := BinaryCodec{}
+	msg := codecTestMessage()
+	data, _ := codec.Encode(msg)
+
+	// a field added by a newer node should not stop an older node from reading the message
+	data = append(data, 0xEE, 0x00, 0x03, 'a', 'b', 'c')
+
+	res, err := codec.Decode(data)
+	if err != nil || !reflect.DeepEqual(msg, res) {
+		t.Fatalf("A message with an unknown extension was not decoded! %s", err)
+	}
+
+	// an extension that claims to be longer than the packet is truncated
+	data = append(data, 0xEE, 0x00, 0x10)
+	if _, err := codec.Decode(data); err != ErrTruncated {
+		t.Fatalf("A truncated extension should be rejected! %v", err)
+	}
+}
+
+// decoding arbitrary bytes should never panic, and whatever is decoded should encode to the same message
+func FuzzBinaryCodecDecode(f *testing.F) {
+	data, _ := BinaryCodec{}.Encode(codecTestMessage())
+	f.Add(data)
+	f.Add([]byte{})
+	f.Add([]byte{0x4B, 0x44, ProtocolVersion, 1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := BinaryCodec{}.Decode(data)
+		if err != nil {
+			return
+		}
+
+		encoded, err := BinaryCodec{}.Encode(msg)
+		if err != nil {
+			t.Fatalf("A decoded message could not be encoded again: %s", err)
+		}
+
+		res, err := BinaryCodec{}.Decode(encoded)
+		if err != nil || !reflect.DeepEqual(msg, res) {
+			t.Fatalf("A decoded message did not survive a round trip! %s", err)
+		}
+	})
+}
+
+func TestBinaryCodecObserved(t *testing.T) {
+	msg := codecTestMessage()
+	msg.Observed = "127.0.0.4:1234"
+
+	data, _ := BinaryCodec{}.Encode(msg)
+	decoded, err := BinaryCodec{}.Decode(data)
+	if err != nil || decoded.Observed != msg.Observed {
+		t.Fatalf("The observed address was not sent! %q %v", decoded.Observed, err)
+	}
+}
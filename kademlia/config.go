@@ -0,0 +1,115 @@
+package kademlia
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// defaults of Config, used for every field that is left zero
+const (
+	DefaultK           = 4 // small enough for the test deployments, the Kademlia paper uses 20
+	DefaultAlpha       = 3
+	DefaultRepublish   = 1 * time.Minute
+	DefaultRefresh     = 1 * time.Hour // as in the Kademlia paper
+	DefaultTimeout     = 5 * time.Second
+	DefaultBootstrapIP = "172.26.0.2:1234"
+	DefaultListenPort  = "1234"
+	DefaultPacketSize  = 1024 * 4
+	DefaultSnapshot    = 1 * time.Minute
+)
+
+// the smallest packet that fits a fragment with some payload
+const minPacketSize = 2 * fragmentHeaderSize
+
+// the largest UDP packet a node can receive, whatever PacketSize its peers use
+const maxUDPPacketSize = 65535
+
+// Config holds the protocol parameters of a node. Every node has its own, so nodes with different
+// settings can run in the same process. Fields that are left zero get their default value.
+type Config struct {
+	K           int           // contacts per bucket, and the number of contacts a lookup returns
+	Alpha       int           // requests a lookup has in flight at the same time
+	Republish   time.Duration // how long stored data is kept before it is stored again
+	Refresh     time.Duration // how long a bucket can go without a lookup in its range before it is refreshed
+	Timeout     time.Duration // how long to wait for a response from a contact without measured round trips
+	BootstrapIP string        // address of the node that is contacted to join the network
+	ListenPort  string        // port messages are received on, "0" picks a free port. Defaults to the port of the address of the node
+	PacketSize  int           // largest UDP packet, larger messages are sent over TCP
+	UDPOnly     bool          // do not use TCP, larger messages are split into fragments and no TCP port is bound
+	DataDir     string        // directory where the identity and the contacts are saved, nothing is saved if empty
+	Snapshot    time.Duration // how often the contacts are saved to DataDir
+	TreeTable   bool          // keep the contacts in a TreeRoutingTable instead of a RoutingTable
+}
+
+// DefaultConfig returns the configuration with every parameter set to its default
+func DefaultConfig() Config {
+	return Config{}.withDefaults()
+}
+
+// withDefaults returns config with every zero field set to its default
+func (config Config) withDefaults() Config {
+	if config.K == 0 {
+		config.K = DefaultK
+	}
+	if config.Alpha == 0 {
+		config.Alpha = DefaultAlpha
+	}
+	if config.Republish == 0 {
+		config.Republish = DefaultRepublish
+	}
+	if config.Refresh == 0 {
+		config.Refresh = DefaultRefresh
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.BootstrapIP == "" {
+		config.BootstrapIP = DefaultBootstrapIP
+	}
+	if config.ListenPort == "" {
+		config.ListenPort = DefaultListenPort
+	}
+	if config.PacketSize == 0 {
+		config.PacketSize = DefaultPacketSize
+	}
+	if config.Snapshot == 0 {
+		config.Snapshot = DefaultSnapshot
+	}
+	return config
+}
+
+// Validate returns an error if a node can not run with config
+func (config Config) Validate() error {
+	config = config.withDefaults()
+
+	if config.K < 1 {
+		return fmt.Errorf("CONFIG ERROR: K has to be at least 1, not %d", config.K)
+	}
+	if config.Alpha < 1 || config.Alpha > config.K {
+		return fmt.Errorf("CONFIG ERROR: Alpha has to be between 1 and K, not %d", config.Alpha)
+	}
+	if config.Republish < 0 {
+		return fmt.Errorf("CONFIG ERROR: Republish can not be negative")
+	}
+	if config.Snapshot < 0 {
+		return fmt.Errorf("CONFIG ERROR: Snapshot can not be negative")
+	}
+	if config.Refresh < 0 {
+		return fmt.Errorf("CONFIG ERROR: Refresh can not be negative")
+	}
+	if config.Timeout < minRTO {
+		return fmt.Errorf("CONFIG ERROR: Timeout has to be at least %s, not %s", minRTO, config.Timeout)
+	}
+	if _, _, err := net.SplitHostPort(config.BootstrapIP); err != nil {
+		return fmt.Errorf("CONFIG ERROR: invalid BootstrapIP: %w", err)
+	}
+	if port, err := strconv.Atoi(config.ListenPort); err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("CONFIG ERROR: invalid ListenPort %q", config.ListenPort)
+	}
+	if config.PacketSize < minPacketSize || config.PacketSize > 65507 { // the largest UDP payload
+		return fmt.Errorf("CONFIG ERROR: PacketSize has to be between %d and 65507, not %d", minPacketSize, config.PacketSize)
+	}
+	return nil
+}
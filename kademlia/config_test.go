@@ -0,0 +1,85 @@
+package kademlia
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	config := Config{K: 20}.withDefaults()
+	if config.K != 20 || config.Alpha != DefaultAlpha || config.Timeout != DefaultTimeout || config.PacketSize != DefaultPacketSize {
+		t.Fatalf("The defaults were not applied to the zero fields only! %+v", config)
+	}
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("The default configuration is invalid! %s", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []Config{
+		{K: -1},
+		{K: 2, Alpha: 3}, // more requests in flight than contacts returned
+		{Alpha: -1},
+		{Republish: -time.Second},
+		{Refresh: -time.Second},
+		{Snapshot: -time.Second},
+		{Timeout: time.Millisecond},
+		{BootstrapIP: "172.26.0.2"},
+		{ListenPort: "65536"},
+		{ListenPort: "http"},
+		{PacketSize: 10},
+		{PacketSize: 65508},
+	}
+	for _, config := range tests {
+		if err := config.Validate(); err == nil {
+			t.Fatalf("An invalid configuration was accepted! %+v", config)
+		}
+	}
+
+	// test that a node is not created with an invalid configuration
+	if _, err := NewKademlia(NewContact(NewRandomKademliaID(), "127.0.0.1:0"), Config{K: -1}); err == nil {
+		t.Fatalf("A node was created with an invalid configuration!")
+	}
+
+	// test that the port to listen on has to be the port the node advertises
+	if _, err := NewKademlia(NewContact(NewRandomKademliaID(), "127.0.0.1:8000"), Config{ListenPort: "8001"}); err == nil {
+		t.Fatalf("A node was created that listens on another port than its address!")
+	}
+	if k, err := NewKademlia(NewContact(NewRandomKademliaID(), "127.0.0.1:8000"), Config{ListenPort: "8000"}); err != nil || k.Config.ListenPort != "8000" {
+		t.Fatalf("A node could not be created with the port of its address! %v", err)
+	}
+	if k, err := NewKademlia(NewContact(NewRandomKademliaID(), "127.0.0.1:8000"), Config{}); err != nil || k.Config.ListenPort != "8000" {
+		t.Fatalf("The port to listen on was not taken from the address! %v", err)
+	}
+}
+
+func TestConfigPerNode(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var sim = NewSimNetwork(1)
+	var small, _ = sim.AddNodeWithConfig(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:8000"), Config{K: 2, Alpha: 1})
+	var large, _ = sim.AddNodeWithConfig(NewContact(NewKademliaID("EFFFFFFF00000000000000000000000000000000"), "127.0.0.1:8001"), Config{K: 8})
+	/*-----------------------------------------------------------------------------------------------*/
+
+	// every contact goes to the same bucket of both nodes
+	for i := 0; i < 10; i++ {
+		contact := NewContact(NewRandomKademliaID(), "127.0.0.1:9000")
+		contact.ID[0] = 0x00
+		small.Rt.AddContact(contact, pingTest)
+		large.Rt.AddContact(contact, pingTest)
+	}
+
+	// test that each node keeps its own k in its buckets and in the responses it sends
+	if small.Rt.K() != 2 || large.Rt.K() != 8 {
+		t.Fatalf("The nodes do not have their own k! %d %d", small.Rt.K(), large.Rt.K())
+	}
+	if contacts := small.Rt.FindClosestContacts(NewRandomKademliaID(), 20); len(contacts) != 2 {
+		t.Fatalf("The small node kept %d contacts instead of 2!", len(contacts))
+	}
+	if contacts := large.Rt.FindClosestContacts(NewRandomKademliaID(), 20); len(contacts) != 8 {
+		t.Fatalf("The large node kept %d contacts instead of 8!", len(contacts))
+	}
+	if small.Network.Rt.Timeout(&Contact{}) != DefaultTimeout || small.Config.Alpha != 1 || large.Config.Alpha != DefaultAlpha {
+		t.Fatalf("The configurations were mixed up! %+v %+v", small.Config, large.Config)
+	}
+}
@@ -11,11 +11,14 @@ type Contact struct {
 	ID       *KademliaID
 	Address  string
 	distance *KademliaID
+
+	Nonce      *KademliaID // solution of the dynamic crypto puzzle of the ID, nil if the node has none
+	AltAddress string      // address of the node in the other IP family, empty for single stack nodes
 }
 
 // NewContact returns a new instance of a Contact
 func NewContact(id *KademliaID, address string) Contact {
-	return Contact{id, address, nil}
+	return Contact{id, address, nil, nil, ""}
 }
 
 // CalcDistance calculates the distance to the target and
@@ -183,3 +183,17 @@ func TestCandidatesLess(t *testing.T) {
 		t.Fatalf("CandidatesLess does not work as intended!")
 	}
 }
+
+func TestCandidatesAppendSameHost(t *testing.T) {
+	// different nodes on the same IP are different candidates
+	c1 := NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:8000")
+	c2 := NewContact(NewKademliaID("EFFFFFFF00000000000000000000000000000000"), "127.0.0.1:8001")
+
+	var cc ContactCandidates
+	cc.Append([]Contact{c1, c2})
+	cc.Append([]Contact{c2})
+
+	if cc.Len() != 2 || cc.contacts[0] != c1 || cc.contacts[1] != c2 {
+		t.Fatalf("Nodes on the same host were not kept apart! %v", cc.contacts)
+	}
+}
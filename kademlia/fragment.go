@@ -0,0 +1,195 @@
+package kademlia
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Messages that do not fit in a single packet are split into fragments. A fragment is laid out as
+//
+//	magic (2 bytes) | RPCID (20 bytes) | index (2 bytes) | total (2 bytes) | payload
+//
+// The magic can never be the start of a whole encoded message, so fragments and messages can
+// be received on the same socket.
+var fragmentMagic = [2]byte{0xFA, 0x6B}
+
+const fragmentHeaderSize = 2 + IDLength + 2 + 2
+
+// incomplete sets of fragments are dropped after this long
+const fragmentTimeout = 10 * time.Second
+
+// the maximum number of messages that can be reassembled at the same time, in total and from a single source IP
+const (
+	maxPendingFragments          = 1024
+	maxPendingFragmentsPerSource = 16
+)
+
+// the most fragments a message can be split into, a message of maxFrameSize in the smallest packets
+const maxFragments = (maxFrameSize + minPacketSize - fragmentHeaderSize - 1) / (minPacketSize - fragmentHeaderSize)
+
+// split data into numbered fragments of at most packetSize bytes each, tagged with rpcID
+func splitFragments(rpcID KademliaID, data []byte, packetSize int) ([][]byte, error) {
+	payloadSize := packetSize - fragmentHeaderSize
+	if payloadSize <= 0 {
+		return nil, fmt.Errorf("packet size %d is too small to fit a fragment", packetSize)
+	}
+
+	total := (len(data) + payloadSize - 1) / payloadSize
+	if total > 0xFFFF || len(data) > maxFrameSize {
+		return nil, fmt.Errorf("message of %d bytes is too large to fragment", len(data))
+	}
+
+	fragments := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		payload := data[i*payloadSize : min((i+1)*payloadSize, len(data))]
+
+		fragment := make([]byte, fragmentHeaderSize+len(payload))
+		copy(fragment, fragmentMagic[:])
+		copy(fragment[2:], rpcID[:])
+		binary.BigEndian.PutUint16(fragment[2+IDLength:], uint16(i))
+		binary.BigEndian.PutUint16(fragment[4+IDLength:], uint16(total))
+		copy(fragment[fragmentHeaderSize:], payload)
+
+		fragments = append(fragments, fragment)
+	}
+
+	return fragments, nil
+}
+
+// isFragment returns true if packet is a fragment of a larger message
+func isFragment(packet []byte) bool {
+	return len(packet) >= fragmentHeaderSize && packet[0] == fragmentMagic[0] && packet[1] == fragmentMagic[1]
+}
+
+// a set of fragments is identified by who sent it and the RPCID it was tagged with
+type fragmentKey struct {
+	source string
+	rpcID  KademliaID
+}
+
+// the fragments of a single message received so far
+type fragmentSet struct {
+	fragments map[int][]byte // map of index : payload, filled as the fragments arrive
+	total     int
+	size      int
+	timer     *time.Timer // drops the set if it is not completed in time
+}
+
+// reassembler collects fragments until every fragment of a message has been received
+type reassembler struct {
+	timeout   time.Duration
+	pending   map[fragmentKey]*fragmentSet
+	perSource map[string]int // map of source IP : sets pending from it
+	lock      sync.Mutex
+}
+
+// newReassembler returns a new instance of a reassembler that drops incomplete messages after timeout
+func newReassembler(timeout time.Duration) *reassembler {
+	return &reassembler{
+		timeout:   timeout,
+		pending:   make(map[fragmentKey]*fragmentSet),
+		perSource: make(map[string]int),
+	}
+}
+
+// Add a fragment received from source. Returns the whole message and true once every fragment has arrived.
+func (r *reassembler) Add(source string, packet []byte) ([]byte, bool) {
+	if !isFragment(packet) {
+		return nil, false
+	}
+
+	var key fragmentKey
+	key.source = source
+	copy(key.rpcID[:], packet[2:])
+	index := int(binary.BigEndian.Uint16(packet[2+IDLength:]))
+	total := int(binary.BigEndian.Uint16(packet[4+IDLength:]))
+	if total == 0 || total > maxFragments || index >= total {
+		return nil, false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	set := r.pending[key]
+	if set == nil {
+		if len(r.pending) >= maxPendingFragments {
+			log.Println("Too many incomplete messages, dropping fragment from", source)
+			return nil, false
+		}
+		if r.perSource[sourceOf(source)] >= maxPendingFragmentsPerSource {
+			log.Println("Too many incomplete messages from", source, "dropping fragment")
+			return nil, false
+		}
+
+		set = &fragmentSet{fragments: make(map[int][]byte), total: total}
+		r.pending[key] = set
+		r.perSource[sourceOf(source)]++
+
+		// drop the set if it has not been completed in time
+		set.timer = time.AfterFunc(r.timeout, func() {
+			r.lock.Lock()
+			if r.pending[key] == set {
+				log.Println("Dropping incomplete message from", source)
+				r.remove(key)
+			}
+			r.lock.Unlock()
+		})
+	}
+
+	if _, ok := set.fragments[index]; ok || set.total != total { // inconsistent or duplicate fragment
+		return nil, false
+	}
+
+	payload := packet[fragmentHeaderSize:]
+	if set.size+len(payload) > maxFrameSize {
+		set.timer.Stop()
+		r.remove(key)
+		return nil, false
+	}
+
+	set.fragments[index] = append([]byte(nil), payload...)
+	set.size += len(payload)
+
+	if len(set.fragments) < total {
+		return nil, false
+	}
+
+	r.remove(key)
+	set.timer.Stop()
+
+	data := make([]byte, 0, set.size)
+	for i := 0; i < total; i++ {
+		data = append(data, set.fragments[i]...)
+	}
+	return data, true
+}
+
+// remove the set of key from the pending sets, the lock must be held
+func (r *reassembler) remove(key fragmentKey) {
+	delete(r.pending, key)
+	source := sourceOf(key.source)
+	if r.perSource[source]--; r.perSource[source] <= 0 {
+		delete(r.perSource, source)
+	}
+}
+
+// Clear drops every incomplete message and stops their timers
+func (r *reassembler) Clear() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for key, set := range r.pending {
+		set.timer.Stop()
+		r.remove(key)
+	}
+}
+
+// Pending returns the number of messages that are waiting for more fragments
+func (r *reassembler) Pending() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.pending)
+}
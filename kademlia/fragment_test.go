@@ -0,0 +1,178 @@
+package kademlia
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitFragments(t *testing.T) {
+	id := *NewRandomKademliaID()
+	data := []byte(strings.Repeat("0123456789", 1000))
+
+	fragments, err := splitFragments(id, data, 1024)
+	if err != nil {
+		t.Fatalf("Could not split data into fragments: %s", err)
+	}
+
+	// test that every fragment fits in a packet
+	for _, f := range fragments {
+		if len(f) > 1024 {
+			t.Fatalf("A fragment is larger than the packet size! %d > 1024", len(f))
+		}
+		if !isFragment(f) {
+			t.Fatalf("A fragment is not recognised as a fragment!")
+		}
+	}
+
+	// test that a packet size that can not hold any payload is rejected
+	if _, err := splitFragments(id, data, fragmentHeaderSize); err == nil {
+		t.Fatalf("A packet size without room for a payload should not be allowed!")
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	r := newReassembler(fragmentTimeout)
+	id := *NewRandomKademliaID()
+	data := []byte(strings.Repeat("0123456789", 1000))
+
+	fragments, _ := splitFragments(id, data, 512)
+
+	// fragments can arrive in any order
+	rand.Shuffle(len(fragments), func(i, j int) { fragments[i], fragments[j] = fragments[j], fragments[i] })
+
+	for i, f := range fragments {
+		res, complete := r.Add("127.0.0.1:1234", f)
+
+		if i < len(fragments)-1 {
+			if complete {
+				t.Fatalf("The message was completed before all fragments were received!")
+			}
+
+			// a duplicated fragment should be ignored
+			if _, dupComplete := r.Add("127.0.0.1:1234", f); dupComplete {
+				t.Fatalf("A duplicated fragment completed the message!")
+			}
+			continue
+		}
+
+		if !complete || string(res) != string(data) {
+			t.Fatalf("The message was not reassembled correctly!")
+		}
+	}
+
+	if r.Pending() != 0 {
+		t.Fatalf("The completed message was not removed from the pending messages!")
+	}
+}
+
+func TestReassembleTimeout(t *testing.T) {
+	r := newReassembler(10 * time.Millisecond)
+	id := *NewRandomKademliaID()
+	data := []byte(strings.Repeat("0123456789", 1000))
+
+	fragments, _ := splitFragments(id, data, 512)
+
+	// only send half of the fragments
+	for _, f := range fragments[:len(fragments)/2] {
+		r.Add("127.0.0.1:1234", f)
+	}
+	if r.Pending() != 1 {
+		t.Fatalf("The incomplete message should be pending!")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if r.Pending() != 0 {
+		t.Fatalf("The incomplete message was not dropped after the timeout!")
+	}
+
+	// the rest of the fragments can no longer complete the message
+	for _, f := range fragments[len(fragments)/2:] {
+		if _, complete := r.Add("127.0.0.1:1234", f); complete {
+			t.Fatalf("A message was completed from fragments of a dropped message!")
+		}
+	}
+}
+
+func TestReassembleLimits(t *testing.T) {
+	r := newReassembler(fragmentTimeout)
+	defer r.Clear()
+
+	// test that a total that no message of maxFrameSize needs is rejected
+	huge := make([]byte, fragmentHeaderSize+1)
+	copy(huge, fragmentMagic[:])
+	copy(huge[2:], NewRandomKademliaID()[:])
+	binary.BigEndian.PutUint16(huge[4+IDLength:], 0xFFFF)
+	if r.Add("127.0.0.1:1234", huge); r.Pending() != 0 {
+		t.Fatalf("A fragment of an impossibly large message was kept!")
+	}
+
+	// test that a single source IP can not take up every slot, even from many ports
+	for i := 0; i < 2*maxPendingFragmentsPerSource; i++ {
+		fragments, _ := splitFragments(*NewRandomKademliaID(), make([]byte, 1000), 512)
+		r.Add(net.JoinHostPort("127.0.0.1", strconv.Itoa(1024+i)), fragments[0])
+	}
+	if r.Pending() != maxPendingFragmentsPerSource {
+		t.Fatalf("A single source has %d incomplete messages, expected %d!", r.Pending(), maxPendingFragmentsPerSource)
+	}
+
+	// test that other sources still have room, and that a completed message frees the slot of its source
+	fragments, _ := splitFragments(*NewRandomKademliaID(), make([]byte, 800), 512)
+	r.Add("127.0.0.2:1234", fragments[0])
+	if _, complete := r.Add("127.0.0.2:1234", fragments[1]); len(fragments) != 2 || !complete {
+		t.Fatalf("The message of another source was not reassembled!")
+	}
+	if r.perSource["127.0.0.2"] != 0 || r.Pending() != maxPendingFragmentsPerSource {
+		t.Fatalf("The completed message was not removed from its source! %v", r.perSource)
+	}
+}
+
+func TestUDPMessengerFragments(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var other = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "127.0.0.1:1235")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer conn.Close()
+	go n.serveUDP(conn)
+
+	// no TCP messenger, so large messages have to be fragmented
+	messenger := &UDPMessenger{Rt: NewRoutingTable(other), PacketSize: 1024}
+
+	id := *NewRandomKademliaID()
+	responseCh := make(chan Message)
+	n.lock.Lock()
+	n.ExpectedResponses[id] = responseCh
+	n.lock.Unlock()
+
+	target := NewContact(me.ID, conn.LocalAddr().String())
+	body := strings.Repeat("c", 20*1024)
+	messenger.SendMessage(&target, Message{MsgType: "FIND_DATA_RESPONSE", RPCID: id, Body: body})
+
+	select {
+	case res := <-responseCh:
+		if res.Body != body {
+			t.Fatalf("The fragmented message was not reassembled correctly!")
+		}
+	case <-time.After(DefaultTimeout):
+		t.Fatalf("The fragmented message was never received!")
+	}
+}
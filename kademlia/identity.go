@@ -0,0 +1,113 @@
+package kademlia
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+)
+
+// Identity is the keypair of a node. The KademliaID of the node is derived from the public key,
+// so a node can neither pretend to be another node nor pick its own position in the keyspace.
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+	Nonce      *KademliaID // solution of the dynamic crypto puzzle of the ID, see Puzzle
+}
+
+var (
+	ErrUnsigned         = errors.New("SIGNATURE ERROR: message is not signed")
+	ErrBadPublicKey     = errors.New("SIGNATURE ERROR: public key is malformed")
+	ErrIDMismatch       = errors.New("SIGNATURE ERROR: sender ID is not derived from the public key")
+	ErrInvalidSignature = errors.New("SIGNATURE ERROR: signature does not match the message")
+)
+
+// NewIdentity returns a new instance of an Identity with a freshly generated keypair
+func NewIdentity() (*Identity, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{PublicKey: publicKey, PrivateKey: privateKey}, nil
+}
+
+// NewIdentityFromSeed returns the Identity belonging to an ed25519 seed
+func NewIdentityFromSeed(seed []byte) (*Identity, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("SIGNATURE ERROR: seed has the wrong length")
+	}
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	return &Identity{PublicKey: privateKey.Public().(ed25519.PublicKey), PrivateKey: privateKey}, nil
+}
+
+// NewKademliaIDFromPublicKey returns the KademliaID that belongs to a public key, the SHA-1 hash of the key
+func NewKademliaIDFromPublicKey(publicKey ed25519.PublicKey) *KademliaID {
+	id := KademliaID(sha1.Sum(publicKey))
+	return &id
+}
+
+// ID returns the KademliaID of the node that holds the identity
+func (identity *Identity) ID() *KademliaID {
+	return NewKademliaIDFromPublicKey(identity.PublicKey)
+}
+
+// Contact returns the contact of the node that holds the identity
+func (identity *Identity) Contact(address string) Contact {
+	contact := NewContact(identity.ID(), address)
+	contact.Nonce = identity.Nonce
+	return contact
+}
+
+// Sign msg, the public key is attached so the receiver can check the signature and the sender ID
+func (identity *Identity) Sign(msg *Message) error {
+	msg.PublicKey = identity.PublicKey
+	msg.Signature = nil
+
+	data, err := signedBytes(*msg)
+	if err != nil {
+		return err
+	}
+
+	msg.Signature = ed25519.Sign(identity.PrivateKey, data)
+	return nil
+}
+
+// VerifyMessage returns an error unless msg is signed by the key its sender ID was derived from
+func VerifyMessage(msg Message) error {
+	if len(msg.Signature) == 0 {
+		return ErrUnsigned
+	}
+	if len(msg.PublicKey) != ed25519.PublicKeySize {
+		return ErrBadPublicKey
+	}
+	if msg.Sender.ID == nil || *msg.Sender.ID != *NewKademliaIDFromPublicKey(msg.PublicKey) {
+		return ErrIDMismatch
+	}
+
+	signature := msg.Signature
+	msg.Signature = nil
+	data, err := signedBytes(msg)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(msg.PublicKey, data, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// the bytes covered by the signature of msg. The advertised address of the sender is included, so
+// nobody can redirect the responses to another port.
+func signedBytes(msg Message) ([]byte, error) {
+	msg.Signature = nil
+
+	data, err := BinaryCodec{}.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// domain separation, so a signature can not be reused for anything else
+	return bytes.Join([][]byte{[]byte("kademlia message signature"), data}, []byte{0}), nil
+}
@@ -0,0 +1,182 @@
+package kademlia
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// identity with a fixed key so the tests are repeatable
+func testIdentity(t testing.TB, b byte) *Identity {
+	identity, err := NewIdentityFromSeed(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatalf("Could not create identity: %s", err)
+	}
+	return identity
+}
+
+func TestIdentityID(t *testing.T) {
+	identity := testIdentity(t, 1)
+
+	// test that the ID is derived from the public key
+	if *identity.ID() != *NewKademliaIDFromPublicKey(identity.PublicKey) {
+		t.Fatalf("The ID was not derived from the public key!")
+	}
+	if *identity.ID() != *testIdentity(t, 1).ID() {
+		t.Fatalf("The same seed gave different IDs!")
+	}
+	if *identity.ID() == *testIdentity(t, 2).ID() {
+		t.Fatalf("Different keys gave the same ID!")
+	}
+
+	if _, err := NewIdentityFromSeed([]byte("short")); err == nil {
+		t.Fatalf("A seed of the wrong length was accepted!")
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	identity := testIdentity(t, 1)
+	other := testIdentity(t, 2)
+	sender := NewContact(identity.ID(), "127.0.0.1:1234")
+
+	signed := func() Message {
+		msg := Message{MsgType: "STORE", Sender: sender, Body: "data", RPCID: *NewKademliaID("1111111100000000000000000000000000000000")}
+		if err := identity.Sign(&msg); err != nil {
+			t.Fatalf("Could not sign message: %s", err)
+		}
+		return msg
+	}
+
+	// test that a signed message survives the wire format
+	data, _ := BinaryCodec{}.Encode(signed())
+	msg, _ := BinaryCodec{}.Decode(data)
+	if err := VerifyMessage(msg); err != nil {
+		t.Fatalf("A valid signature was rejected! %s", err)
+	}
+
+	// test that the advertised address can not be changed
+	msg.Sender.Address = "127.0.0.1:4321"
+	if err := VerifyMessage(msg); err != ErrInvalidSignature {
+		t.Fatalf("A changed address was accepted! %v", err)
+	}
+
+	// test that changes to the message are detected
+	tampered := signed()
+	tampered.Body = "other data"
+	if err := VerifyMessage(tampered); err != ErrInvalidSignature {
+		t.Fatalf("A tampered message was accepted! %v", err)
+	}
+
+	// test that a sender can not claim the ID of another node
+	spoofed := signed()
+	spoofed.Sender.ID = other.ID()
+	if err := VerifyMessage(spoofed); err != ErrIDMismatch {
+		t.Fatalf("A spoofed sender ID was accepted! %v", err)
+	}
+
+	// test that a message signed with another key is rejected
+	forged := signed()
+	forged.Sender.ID = other.ID()
+	forged.PublicKey = other.PublicKey
+	if err := VerifyMessage(forged); err != ErrInvalidSignature {
+		t.Fatalf("A forged signature was accepted! %v", err)
+	}
+
+	if err := VerifyMessage(Message{MsgType: "PING", Sender: sender}); err != ErrUnsigned {
+		t.Fatalf("An unsigned message was accepted! %v", err)
+	}
+}
+
+func TestHandlePacketVerifiesSignature(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var identity = testIdentity(t, 1)
+	var me = NewContact(identity.ID(), "127.0.0.1:1234")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+		Identity:          identity,
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	source := net.IPv4(127, 0, 0, 2)
+	sender := testIdentity(t, 2)
+
+	// unsigned, and signed by a key that does not belong to the sender ID
+	unsigned, _ := BinaryCodec{}.Encode(Message{MsgType: "PING", Sender: NewContact(sender.ID(), "")})
+	forgedMsg := Message{MsgType: "PING", Sender: NewContact(sender.ID(), "")}
+	testIdentity(t, 3).Sign(&forgedMsg)
+	forged, _ := BinaryCodec{}.Encode(forgedMsg)
+	for _, packet := range [][]byte{unsigned, forged} {
+		n.handlePacket(packet, source)
+	}
+
+	if count := n.InvalidPackets(source.String()); count != 2 {
+		t.Fatalf("The untrusted packets were not dropped! %d != 2", count)
+	}
+	if _, err := n.Messenger.(*MockMessenger).GetLatestMessage(); err == nil {
+		t.Fatalf("An untrusted packet was handled!")
+	}
+
+	// test that a valid signed message is handled
+	validMsg := Message{MsgType: "PING", Sender: NewContact(sender.ID(), "")}
+	sender.Sign(&validMsg)
+	valid, _ := BinaryCodec{}.Encode(validMsg)
+	n.handlePacket(valid, source)
+	time.Sleep(10 * time.Millisecond)
+	if res, err := n.Messenger.(*MockMessenger).GetLatestMessage(); err != nil || res.MsgType != "PONG" {
+		t.Fatalf("A validly signed packet was not handled!")
+	}
+	if count := n.InvalidPackets(source.String()); count != 2 {
+		t.Fatalf("A validly signed packet was counted as invalid!")
+	}
+}
+
+func TestUDPMessengerSigns(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var identity = testIdentity(t, 1)
+	var me = NewContact(identity.ID(), "127.0.0.1:1234")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+		Identity:          identity,
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer conn.Close()
+	go n.serveUDP(conn)
+
+	id := *NewRandomKademliaID()
+	responseCh := make(chan Message, 1)
+	n.lock.Lock()
+	n.ExpectedResponses[id] = responseCh
+	n.lock.Unlock()
+
+	sender := testIdentity(t, 2)
+	messenger := &UDPMessenger{Rt: NewRoutingTable(NewContact(sender.ID(), "127.0.0.1:1235")), Identity: sender}
+	target := NewContact(me.ID, conn.LocalAddr().String())
+	messenger.SendMessage(&target, Message{MsgType: "PONG", RPCID: id})
+
+	select {
+	case res := <-responseCh:
+		if !bytes.Equal(res.PublicKey, sender.PublicKey) {
+			t.Fatalf("The message was not signed by the messenger!")
+		}
+	case <-time.After(DefaultTimeout):
+		t.Fatalf("The signed message was not received!")
+	}
+}
@@ -1,41 +1,143 @@
 package kademlia
 
 import (
+	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
-const tRepublish = 1 * time.Minute
-
-const Alpha = 3
-
-// Default network values
-const BootstrapIP = "172.26.0.2:1234"
-const ListenPort = "1234"
-const PacketSize = 1024 * 4
+// ErrNotFound is returned when a lookup did not find the requested data
+var ErrNotFound = errors.New("The requested object could not be downloaded")
 
 type Kademlia struct {
 	Network *Network
-	Rt      *RoutingTable
+	Rt      ContactTable
+	Config  Config // parameters of this node, every field is set
+}
+
+// Creates a new instance of the Kademlia with the parameters of config, zero fields get their default
+func NewKademlia(me Contact, config Config) (*Kademlia, error) {
+	return newKademlia(me, nil, config)
 }
 
-// Creates a new instance of the Kademlia
-func NewKademlia(me Contact) *Kademlia {
-	Rt := NewRoutingTable(me)
+// Creates a new instance of the Kademlia for the node that holds identity. The ID of the node is
+// derived from the public key and every message is signed.
+func NewKademliaWithIdentity(identity *Identity, address string, config Config) (*Kademlia, error) {
+	return newKademlia(identity.Contact(address), identity, config)
+}
+
+func newKademlia(me Contact, identity *Identity, config Config) (*Kademlia, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	// listen on the port the node advertises in its address
+	if _, port, err := net.SplitHostPort(me.Address); err == nil {
+		if config.ListenPort != "" && config.ListenPort != port {
+			return nil, fmt.Errorf("CONFIG ERROR: ListenPort %q differs from the port of the address %q", config.ListenPort, me.Address)
+		}
+		config.ListenPort = port
+	}
+	config = config.withDefaults()
+
+	var Rt ContactTable = NewRoutingTableWithConfig(me, config)
+	if config.TreeTable {
+		Rt = NewTreeRoutingTable(me, config)
+	}
+	var tcp *TCPMessenger // messages that do not fit in a packet are split into fragments without it
+	if !config.UDPOnly {
+		tcp = &TCPMessenger{Rt: Rt, Identity: identity, Timeout: config.Timeout}
+	}
 	return &Kademlia{
 		Network: &Network{
 			Rt:                Rt,
-			BootstrapIP:       BootstrapIP,
-			ListenPort:        ListenPort,
-			PacketSize:        PacketSize,
+			BootstrapIP:       config.BootstrapIP,
+			ListenPort:        config.ListenPort,
+			PacketSize:        config.PacketSize,
+			UDPOnly:           config.UDPOnly,
 			ExpectedResponses: make(map[KademliaID]chan Message, 10),
-			Messenger:         &UDPMessenger{Rt: Rt},
+			Messenger: &UDPMessenger{
+				Rt:         Rt,
+				PacketSize: config.PacketSize,
+				TCP:        tcp,
+				Identity:   identity,
+			},
+			Identity: identity,
 		},
-		Rt: Rt,
+		Rt:     Rt,
+		Config: config,
+	}, nil
+}
+
+// Start listening for messages in the background, see Network.Start
+func (kademlia *Kademlia) Start() error {
+	return kademlia.Network.Start()
+}
+
+// Close stops the node. Running lookups and requests fail with ErrNetworkClosed and data is no longer republished.
+// The contacts are saved first if the node has a data directory.
+func (kademlia *Kademlia) Close() error {
+	if err := kademlia.SaveContacts(); err != nil {
+		log.Println("PERSIST ERROR:", err)
+	}
+	return kademlia.Network.Close()
+}
+
+// store data again after the republish interval, unless the network is closed before that
+func (kademlia *Kademlia) republish(data []byte) {
+	timer := time.NewTimer(kademlia.Config.Republish)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		kademlia.Store(data)
+	case <-kademlia.Network.closing():
+	}
+}
+
+// RefreshLoop refreshes the buckets that had no lookup in their range for Config.Refresh, until
+// the network is closed. A bucket can be stale for a tenth of the interval before it is noticed.
+func (kademlia *Kademlia) RefreshLoop() {
+	ticker := time.NewTicker(max(kademlia.Config.Refresh/10, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			kademlia.RefreshBuckets()
+		case <-kademlia.Network.closing():
+			return
+		}
+	}
+}
+
+// RefreshBuckets looks up a random ID in the range of every stale bucket, which replaces the
+// contacts that stopped responding with the contacts that are in the range now
+func (kademlia *Kademlia) RefreshBuckets() {
+	kademlia.refreshBuckets(kademlia.Config.Refresh)
+}
+
+// look up a random ID in the range of every bucket that had no lookup for interval, Alpha lookups at a time
+func (kademlia *Kademlia) refreshBuckets(interval time.Duration) {
+	var wg sync.WaitGroup
+	running := make(chan struct{}, kademlia.Config.Alpha) // a slot for every running lookup
+	for _, index := range kademlia.Rt.StaleBuckets(interval) {
+		running <- struct{}{}
+		log.Println("[REFRESH] Refreshing bucket", index)
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			defer func() { <-running }()
+			kademlia.LookupContact(*kademlia.Rt.RandomIDInBucket(index))
+		}(index)
 	}
+	wg.Wait()
 }
 
 // Local function used to update what contacts have been contacted
@@ -48,14 +150,14 @@ func (kademlia *Kademlia) updateContacts(
 	findFunc func(KademliaID, *Contact, chan Message),
 ) {
 	// For each contact of the k-closest
-	for _, closestContact := range closest.GetContacts(bucketSize) {
+	for _, closestContact := range closest.GetContacts(kademlia.Config.K) {
 		// Continue to the next contact if already contacted
 		if (*contacted)[closestContact.Address] {
 			continue
 		}
 
 		// Stop sending find contact requests if reached alpha nodoes
-		if len(*contacts) >= Alpha {
+		if len(*contacts) >= kademlia.Config.Alpha {
 			break
 		}
 
@@ -70,13 +172,21 @@ func (kademlia *Kademlia) updateContacts(
 
 // Implements NodeLookup in Kademlia. Finds the k closest nodes to an KademlaiID.
 func (kademlia *Kademlia) LookupContact(target KademliaID) []Contact {
+	closest, _ := kademlia.LookupContactContext(context.Background(), target)
+	return closest
+}
+
+// Finds the k closest nodes to an KademliaID. If ctx is done before the lookup has finished,
+// the closest nodes found so far are returned together with the reason.
+func (kademlia *Kademlia) LookupContactContext(ctx context.Context, target KademliaID) ([]Contact, error) {
 	log.Println("[FIND_CONTACT] Performing lookup contact")
 	var closest ContactCandidates
 	var contacted map[string]bool = map[string]bool{}
-	responses := make(chan Message, 5)
+	responses := make(chan Message, kademlia.Config.Alpha) // room for every request in flight, so none blocks after the lookup returns
+	kademlia.Rt.markLookup(&target)
 
 	// For each contact of the initial k-closest contacts to the target
-	for _, contact := range kademlia.Rt.FindClosestContacts(&target, bucketSize) {
+	for _, contact := range kademlia.Rt.FindClosestContacts(&target, kademlia.Config.K) {
 		// Calculate the distance to the target
 		contact.CalcDistance(&target)
 
@@ -94,19 +204,26 @@ func (kademlia *Kademlia) LookupContact(target KademliaID) []Contact {
 		closest.Sort()
 
 		// For each contact of the k-closest
-		kademlia.updateContacts(&contacted, &closest, &contacts, responses, target, kademlia.Network.SendFindContactMessage)
+		kademlia.updateContacts(&contacted, &closest, &contacts, responses, target, findContactFunc(ctx, kademlia.Network))
 
 		// For each contact that was sent a find contact message
 		for i := 0; i < len(contacts); i++ {
 			// Receive the response from the channel
-			message := <-responses
+			var message Message
+			select {
+			case message = <-responses:
+			case <-ctx.Done():
+				closest.Sort()
+				return closest.GetContacts(kademlia.Config.K), ctx.Err()
+			}
+			message.Contacts = kademlia.Rt.Puzzle().Filter(message.Contacts) // drop contacts with IDs that are too cheap
 
 			// Print list of contacts and add contact to routing table
 			log.Println("[FIND_CONTACT] Got contact response: ")
 			for _, foundContact := range message.Contacts {
 				sender := foundContact
-				sender.CalcDistance(kademlia.Rt.me.ID) // calc distance to self
-				fmt.Println("SENDER ID:", sender.ID, "\nME ID:", kademlia.Rt.me.ID, "\nDISTANCE:", sender.distance, "\nDISTANCE ADDRESS", &sender.distance)
+				sender.CalcDistance(kademlia.Rt.Me().ID) // calc distance to self
+				fmt.Println("SENDER ID:", sender.ID, "\nME ID:", kademlia.Rt.Me().ID, "\nDISTANCE:", sender.distance, "\nDISTANCE ADDRESS", &sender.distance)
 				fmt.Println("CURRENT SENDER:", sender)
 				kademlia.Rt.AddContact(sender, kademlia.Network.SendPingMessage)
 				log.Printf("  %s\n", foundContact.ID.String())
@@ -124,33 +241,72 @@ func (kademlia *Kademlia) LookupContact(target KademliaID) []Contact {
 
 		// If there are no k closest contacts that are uncontacted, return k closest contacts
 		if len(contacts) == 0 {
-			return closest.GetContacts(bucketSize)
+			return closest.GetContacts(kademlia.Config.K), nil
 		}
 	}
 }
 
-// Used when a node joins a kademlia network.
+// returns a find function for updateContacts that sends FIND_CONTACT messages which are aborted when ctx is done
+func findContactFunc(ctx context.Context, network *Network) func(KademliaID, *Contact, chan Message) {
+	return func(id KademliaID, contact *Contact, out chan Message) {
+		response, err := network.FindContactContext(ctx, id, contact)
+		contactFailed(ctx, network, contact, err)
+		out <- response
+	}
+}
+
+// returns a find function for updateContacts that sends FIND_DATA messages which are aborted when ctx is done
+func findDataFunc(ctx context.Context, network *Network) func(KademliaID, *Contact, chan Message) {
+	return func(hash KademliaID, contact *Contact, out chan Message) {
+		response, err := network.FindDataContext(ctx, hash, contact)
+		contactFailed(ctx, network, contact, err)
+		out <- response
+	}
+}
+
+// replace contact in the routing table if it did not respond to a lookup, and not because ctx was done.
+// Lookup requests are not retried, so a single lost packet is no reason to replace the contact. It is
+// only replaced once it also failed to answer a ping, which is retried, in the background so the lookup
+// does not wait for it.
+func contactFailed(ctx context.Context, network *Network, contact *Contact, err error) {
+	if !errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+		return
+	}
+	failed := *contact
+	go func() {
+		if _, err := network.PingContext(context.Background(), &failed); errors.Is(err, context.DeadlineExceeded) {
+			network.Rt.ContactFailed(&failed)
+		}
+	}()
+}
+
+// Used when a node joins a kademlia network. A restarted node rejoins through the saved contacts
+// that are still alive, the bootstrap node is only used if none of them is. As in the paper the
+// node then refreshes every bucket farther away than its closest neighbor.
 func (kademlia *Kademlia) JoinNetwork() {
-	for {
+	rejoined := kademlia.rejoin(context.Background())
+	for !rejoined {
 		log.Println("Joining network")
-		response := make(chan Message)
-		go kademlia.Network.SendPingMessage(&Contact{Address: kademlia.Network.BootstrapIP}, response) // ping bootstrap node so that it is added to routing table
-		r := <-response
+		r, err := kademlia.Network.PingContext(context.Background(), &Contact{Address: kademlia.Network.BootstrapIP}) // ping bootstrap node so that it is added to routing table
 		if r.MsgType == "PONG" {
+			// the sender of a response is added in the background, but the lookup below needs it now
+			kademlia.Rt.AddContact(r.Sender, kademlia.Network.SendPingMessage)
 			break
+		} else if errors.Is(err, ErrNetworkClosed) {
+			return
 		} else {
 			log.Println("Timeout joining network")
 		}
 	}
 
-	kademlia.LookupContact(*kademlia.Rt.me.ID) // lookup on this node to add close nodes to routing table
+	kademlia.LookupContact(*kademlia.Rt.Me().ID) // lookup on this node to add close nodes to routing table
+	kademlia.refreshBuckets(0)                   // the buckets farther than the closest node are not filled by that lookup
 	rtInfo := "[JOIN] Routing table after joining:\n"
-	currRt := kademlia.Network.Rt.buckets
 
-	for i, val := range currRt {
-		rtInfo += "Content in bucket " + strconv.Itoa(i) + "\n"
-		for e := val.list.Front(); e != nil; e = e.Next() {
-			rtInfo += "  " + e.Value.(Contact).ID.String() + "\n"
+	for _, bucket := range kademlia.Rt.Buckets() {
+		rtInfo += "Content in bucket " + strconv.Itoa(bucket.Index) + "\n"
+		for _, contact := range bucket.Contacts {
+			rtInfo += "  " + contact.ID.String() + "\n"
 		}
 	}
 
@@ -161,14 +317,24 @@ func (kademlia *Kademlia) JoinNetwork() {
 // should return a string with the result. if the data could be found a string with the data and node it
 // was retrived from should be returned. otherwise just return that the file could not be found
 func (kademlia *Kademlia) LookupData(hash string) string {
+	res, err := kademlia.LookupDataContext(context.Background(), hash)
+	if err != nil {
+		return "The requested object could not be downloaded"
+	}
+	return res
+}
+
+// Looks up the data associated with hash until ctx is done. Returns ErrNotFound if no node has the data.
+func (kademlia *Kademlia) LookupDataContext(ctx context.Context, hash string) (string, error) {
 	log.Println("[FIND_DATA] Performing lookup data")
 	var closest ContactCandidates
 	var contacted map[string]bool = map[string]bool{}
-	responses := make(chan Message, 5)
+	responses := make(chan Message, kademlia.Config.Alpha) // room for every request in flight, so none blocks after the lookup returns
 	id := NewKademliaID(hash)
+	kademlia.Rt.markLookup(id)
 
 	// For each contact of the initial k-closest contacts to the target
-	for _, contact := range kademlia.Rt.FindClosestContacts(id, bucketSize) {
+	for _, contact := range kademlia.Rt.FindClosestContacts(id, kademlia.Config.K) {
 		// Calculate the distance to the target
 		contact.CalcDistance(id)
 
@@ -186,20 +352,26 @@ func (kademlia *Kademlia) LookupData(hash string) string {
 		closest.Sort()
 
 		// For each contact of the k-closest
-		kademlia.updateContacts(&contacted, &closest, &contacts, responses, *id, kademlia.Network.SendFindDataMessage)
+		kademlia.updateContacts(&contacted, &closest, &contacts, responses, *id, findDataFunc(ctx, kademlia.Network))
 
 		// For each contact that was sent a find contact message
 		for i := 0; i < len(contacts); i++ {
 			// Receive the response from the channel
-			message := <-responses
+			var message Message
+			select {
+			case message = <-responses:
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+			message.Contacts = kademlia.Rt.Puzzle().Filter(message.Contacts) // drop contacts with IDs that are too cheap
 			if message.Body != "" {
-				return message.Body
+				return message.Body, nil
 			}
 
 			// Add contacts to routing table
 			for _, foundContact := range message.Contacts {
 				sender := foundContact
-				sender.CalcDistance(kademlia.Rt.me.ID) // calc distance to self
+				sender.CalcDistance(kademlia.Rt.Me().ID) // calc distance to self
 				go kademlia.Rt.AddContact(sender, kademlia.Network.SendPingMessage)
 			}
 
@@ -213,9 +385,9 @@ func (kademlia *Kademlia) LookupData(hash string) string {
 			closest.Append(message.Contacts)
 		}
 
-		// If there are no k closest contacts that are uncontacted, return k closest contacts
+		// If there are no k closest contacts that are uncontacted, the data could not be found
 		if len(contacts) == 0 {
-			return "The requested object could not be downloaded"
+			return "", ErrNotFound
 		}
 	}
 }
@@ -223,6 +395,11 @@ func (kademlia *Kademlia) LookupData(hash string) string {
 // should return the hash of the data if it was successfully uploaded.
 // an error should be returned if the data could not be uploaded
 func (kademlia *Kademlia) Store(data []byte) (error, string) {
+	return kademlia.StoreContext(context.Background(), data)
+}
+
+// Stores data on the k closest nodes to its hash. The lookup of the closest nodes is aborted if ctx is done.
+func (kademlia *Kademlia) StoreContext(ctx context.Context, data []byte) (error, string) {
 	// check that data fits requriements for KademliaID
 	h := sha1.New()
 	h.Write(data)
@@ -232,7 +409,10 @@ func (kademlia *Kademlia) Store(data []byte) (error, string) {
 	var dataID KademliaID = res
 
 	// find the K nearest nodes
-	closestNodes := kademlia.LookupContact(dataID)
+	closestNodes, err := kademlia.LookupContactContext(ctx, dataID)
+	if err != nil {
+		return err, dataID.String()
+	}
 
 	for _, n := range closestNodes {
 		fmt.Println("[STORE]: Closest nodes to string:", "\n ID:", n.ID, "\n ADDRESS", n.Address, "\n DIST:", n.distance)
@@ -243,10 +423,7 @@ func (kademlia *Kademlia) Store(data []byte) (error, string) {
 		kademlia.Network.SendStoreMessage(dataID, data, &n)
 	}
 
-	go func() { // republish the data
-		time.Sleep(tRepublish)
-		kademlia.Store(data)
-	}()
+	go kademlia.republish(data)
 
 	return nil, dataID.String()
 }
@@ -1,10 +1,39 @@
 package kademlia
 
 import (
+	"context"
 	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
+// a node with the default configuration
+func newTestKademlia(t testing.TB, me Contact) *Kademlia {
+	kademlia, err := NewKademlia(me, Config{})
+	if err != nil {
+		t.Fatalf("Could not create node: %s", err)
+	}
+	return kademlia
+}
+
+// a node with the default configuration that signs its messages with identity
+func newTestKademliaWithIdentity(t testing.TB, identity *Identity, address string) *Kademlia {
+	kademlia, err := NewKademliaWithIdentity(identity, address, Config{})
+	if err != nil {
+		t.Fatalf("Could not create node: %s", err)
+	}
+	return kademlia
+}
+
+// the contact of node, for the functions that take a *Contact
+func contactOf(node *Kademlia) *Contact {
+	me := node.Rt.Me()
+	return &me
+}
+
 func TestLookupContact(t *testing.T) {
 	// Sample contacts
 	/*var details []Detail = []Detail{
@@ -20,7 +49,7 @@ func TestLookupContact(t *testing.T) {
 		contacts = append(contacts, GetContact(detail))
 	}
 
-	var k Kademlia = *NewKademlia(contacts[0])
+	var k Kademlia = *newTestKademlia(t, contacts[0])
 	for _, contact := range contacts {
 		k.Rt.AddContact(contact)
 	}
@@ -31,7 +60,7 @@ func TestLookupContact(t *testing.T) {
 }
 
 func TestNewKademlia(t *testing.T) {
-	lKademlia := NewKademlia(Contact{})
+	lKademlia := newTestKademlia(t, Contact{})
 	var lKademliaType interface{} = lKademlia
 
 	// test if func return a Kademlia
@@ -63,10 +92,10 @@ func TestUpdateContact(t *testing.T) {
 		NewContact(NewKademliaID("DFFFFFFF00000000000000000000000000000000"), "127.0.0.11:1234"),
 	}
 	var otherKademlias []Kademlia = []Kademlia{
-		*NewKademlia(localContacts[0]),
-		*NewKademlia(localContacts[1]),
-		*NewKademlia(localContacts[2]),
-		*NewKademlia(localContacts[3]),
+		*newTestKademlia(t, localContacts[0]),
+		*newTestKademlia(t, localContacts[1]),
+		*newTestKademlia(t, localContacts[2]),
+		*newTestKademlia(t, localContacts[3]),
 	}
 	var pingTest = func(_ *Contact, out chan Message) {
 		m := Message{
@@ -90,7 +119,7 @@ func TestUpdateContact(t *testing.T) {
 
 	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
 
-	var k Kademlia = *NewKademlia(me)
+	var k Kademlia = *newTestKademlia(t, me)
 
 	k.Rt.AddContact(localContacts[0], pingTest)
 	k.Rt.AddContact(localContacts[1], pingTest)
@@ -100,8 +129,8 @@ func TestUpdateContact(t *testing.T) {
 	// finds the kademlia with the contact ID and gets the closest contacts to kId
 	findFunc := func(kId KademliaID, c *Contact, ch chan Message) {
 		for _, i := range otherKademlias {
-			if i.Rt.me.ID == c.ID {
-				foundContacts := i.Network.Rt.FindClosestContacts(&kId, bucketSize)
+			if i.Rt.Me().ID == c.ID {
+				foundContacts := i.Network.Rt.FindClosestContacts(&kId, DefaultK)
 				ch <- Message{
 					Contacts: foundContacts,
 				}
@@ -109,7 +138,7 @@ func TestUpdateContact(t *testing.T) {
 		}
 	}
 
-	for _, contact := range k.Rt.FindClosestContacts(&target, bucketSize) {
+	for _, contact := range k.Rt.FindClosestContacts(&target, DefaultK) {
 		// Calculate the distance to the target
 		contact.CalcDistance(&target)
 
@@ -134,3 +163,239 @@ func TestUpdateContact(t *testing.T) {
 
 	fmt.Println(res)
 }
+
+func TestLookupContactContext(t *testing.T) {
+	sim := NewSimNetwork(1)
+	me := sim.AddNode(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "a"))
+
+	// a node that will never answer
+	dead := NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "dead")
+	me.Rt.AddContact(dead, pingTest)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	closest, err := me.LookupContactContext(ctx, *NewRandomKademliaID())
+	if err != context.DeadlineExceeded {
+		t.Fatalf("The lookup should have been aborted by the deadline! %v", err)
+	}
+	if time.Since(start) > DefaultTimeout/2 {
+		t.Fatalf("The aborted lookup kept waiting for the unresponsive node!")
+	}
+	if len(closest) != 1 || *closest[0].ID != *dead.ID {
+		t.Fatalf("The aborted lookup should return the closest contacts found so far! %v", closest)
+	}
+
+	// the data lookup can be aborted the same way
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := me.LookupDataContext(ctx, NewRandomKademliaID().String()); err != context.Canceled {
+		t.Fatalf("The data lookup should have been aborted! %v", err)
+	}
+}
+
+func TestAbortedLookupLeavesNoGoroutines(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var sim = NewSimNetwork(1)
+	var me, err = sim.AddNodeWithConfig(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "a"), Config{K: 20, Alpha: 8})
+	/*-----------------------------------------------------------------------------------------------*/
+	if err != nil {
+		t.Fatalf("Could not create node: %s", err)
+	}
+
+	// more nodes that never answer than the lookup sends requests to at once
+	for i := 0; i < 2*me.Config.Alpha; i++ {
+		me.Rt.AddContact(NewContact(NewRandomKademliaID(), "dead"+strconv.Itoa(i)), pingTest)
+	}
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	me.LookupContactContext(ctx, *NewRandomKademliaID())
+	me.LookupDataContext(ctx, NewRandomKademliaID().String())
+
+	// test that the requests still in flight when the lookups returned did not block
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("The aborted lookups left goroutines behind! %d > %d", after, before)
+	}
+}
+
+// a messenger that loses every message of type lost, and counts the pings it sends
+type lossyMessenger struct {
+	Messenger
+	lost  string
+	pings int
+	lock  sync.Mutex
+}
+
+func (m *lossyMessenger) SendMessage(contact *Contact, msg Message) {
+	m.lock.Lock()
+	if msg.MsgType == "PING" {
+		m.pings++
+	}
+	m.lock.Unlock()
+	if msg.MsgType != m.lost {
+		m.Messenger.SendMessage(contact, msg)
+	}
+}
+
+func (m *lossyMessenger) Pings() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.pings
+}
+
+func TestLookupConfirmsFailedContact(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var sim = NewSimNetwork(1)
+	var me, err = sim.AddNodeWithConfig(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "a"), Config{K: 1, Alpha: 1, Timeout: minRTO})
+	var lossy = sim.AddNode(NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "b"))
+	var candidate = NewContact(NewKademliaID("2FFFFFFF00000000000000000000000000000000"), "c")
+	var messenger = &lossyMessenger{Messenger: me.Network.Messenger, lost: "FIND_CONTACT"}
+	/*-----------------------------------------------------------------------------------------------*/
+	if err != nil {
+		t.Fatalf("Could not create node: %s", err)
+	}
+	me.Network.Messenger = messenger
+	me.Rt.AddContact(lossy.Rt.Me(), pingTest)
+	me.Rt.AddContact(candidate, pingTest) // waits in the replacement cache, the bucket holds one contact
+
+	// test that a contact that lost a lookup request but answers a ping is kept
+	me.LookupContact(*NewRandomKademliaID())
+	for deadline := time.Now().Add(time.Second); messenger.Pings() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("The contact that did not answer the lookup was not pinged!")
+		}
+	}
+	time.Sleep(50 * time.Millisecond) // the pong is delivered right away
+	if bucket := me.Rt.Buckets()[0]; len(bucket.Contacts) != 1 || *bucket.Contacts[0].ID != *lossy.Rt.Me().ID {
+		t.Fatalf("A contact that answers pings was replaced after one lost request! %+v", bucket)
+	}
+}
+
+func TestCloseStopsRepublish(t *testing.T) {
+	k := newTestKademlia(t, NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234"))
+
+	done := make(chan bool)
+	go func() {
+		k.republish([]byte("data"))
+		done <- true
+	}()
+
+	k.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("The data was still going to be republished after the node was closed!")
+	}
+}
+
+func TestRefreshBuckets(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var sim = NewSimNetwork(1)
+	var node = sim.AddNode(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "a"))
+	var known = sim.AddNode(NewContact(NewKademliaID("7FFFFFFF00000000000000000000000000000000"), "b"))
+	var hidden = sim.AddNode(NewContact(NewKademliaID("0FFFFFFF00000000000000000000000000000000"), "c"))
+	/*-----------------------------------------------------------------------------------------------*/
+
+	// only the known node knows about the hidden node, both are in the range of bucket 0
+	node.Rt.AddContact(known.Rt.Me(), pingTest)
+	known.Rt.AddContact(hidden.Rt.Me(), pingTest)
+
+	for _, bucket := range node.Rt.(*RoutingTable).buckets {
+		bucket.lastLookup = time.Now().Add(-2 * node.Config.Refresh)
+	}
+	node.RefreshBuckets()
+
+	// test that the stale bucket had a lookup, which found the hidden node
+	if stale := node.Rt.StaleBuckets(node.Config.Refresh); len(stale) != 0 {
+		t.Fatalf("Buckets are still stale after the refresh! %v", stale)
+	}
+	if closest := node.Rt.FindClosestContacts(hidden.Rt.Me().ID, 1); len(closest) != 1 || *closest[0].ID != *hidden.Rt.Me().ID {
+		t.Fatalf("The refresh did not find the node in the range of the bucket! %v", closest)
+	}
+}
+
+func TestCloseStopsRefresh(t *testing.T) {
+	k := newTestKademlia(t, NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234"))
+
+	done := make(chan bool)
+	go func() {
+		k.RefreshLoop()
+		done <- true
+	}()
+
+	k.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("The buckets were still going to be refreshed after the node was closed!")
+	}
+}
+
+func TestLookupReplacesFailedContact(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var sim = NewSimNetwork(1)
+	var node, _ = sim.AddNodeWithConfig(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "a"), Config{Timeout: minRTO})
+	var candidate = sim.AddNode(NewContact(NewKademliaID("2FFFFFFF00000000000000000000000000000000"), "b"))
+	var dead = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "dead")
+	/*-----------------------------------------------------------------------------------------------*/
+
+	node.Rt.AddContact(dead, pingTest)
+	node.Rt.(*RoutingTable).buckets[0].addReplacement(candidate.Rt.Me(), false)
+
+	// test that the contact that does not answer the lookup is replaced by the candidate, once it
+	// did not answer the ping that confirms it failed either
+	node.LookupContact(*NewRandomKademliaID())
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if bucket := node.Rt.Buckets()[0]; len(bucket.Contacts) == 1 && *bucket.Contacts[0].ID == *candidate.Rt.Me().ID {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("The failed contact was not replaced! %v", bucket.Contacts)
+		}
+	}
+}
+
+func TestRefreshBucketsBounded(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var node, _ = NewKademlia(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234"), Config{Alpha: 1, Timeout: minRTO})
+	var messenger = &MockMessenger{Rt: node.Rt}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	// contacts that never answer, in the ranges of buckets 0, 1 and 2
+	node.Network.Messenger = messenger
+	for _, id := range []string{"7FFFFFFF00000000000000000000000000000000", "BFFFFFFF00000000000000000000000000000000", "DFFFFFFF00000000000000000000000000000000"} {
+		node.Rt.AddContact(NewContact(NewKademliaID(id), "127.0.0.2:1234"), pingTest)
+	}
+
+	done := make(chan bool)
+	go func() {
+		node.refreshBuckets(0)
+		done <- true
+	}()
+
+	// test that only Alpha lookups are started before the first one times out
+	time.Sleep(minRTO / 2)
+	messenger.lock.Lock()
+	sent := len(messenger.Messages)
+	messenger.lock.Unlock()
+	if sent != 1 {
+		t.Fatalf("%d requests were sent at the same time instead of 1!", sent)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * minRTO):
+		t.Fatalf("The refresh never finished!")
+	}
+}
@@ -1,8 +1,9 @@
 package kademlia
 
 import (
+	"crypto/rand"
 	"encoding/hex"
-	"math/rand"
+	"math/bits"
 )
 
 // the static number of bytes in a KademliaID
@@ -23,16 +24,46 @@ func NewKademliaID(data string) *KademliaID {
 	return &newKademliaID
 }
 
-// NewRandomKademliaID returns a new instance of a random KademliaID,
-// change this to a better version if you like
+// NewRandomKademliaID returns a new instance of a random KademliaID. The bytes come from a
+// cryptographically secure source, so IDs used as RPCIDs can not be guessed by other nodes.
 func NewRandomKademliaID() *KademliaID {
 	newKademliaID := KademliaID{}
-	for i := 0; i < IDLength; i++ {
-		newKademliaID[i] = uint8(rand.Intn(256))
+	if _, err := rand.Read(newKademliaID[:]); err != nil {
+		panic(err) // the system has no source of randomness, nothing is secure
 	}
 	return &newKademliaID
 }
 
+// NewRandomKademliaIDWithPrefix returns a random KademliaID that has exactly the first length bits in
+// common with prefix, so it is in the range of the bucket with index length of a node with ID prefix.
+// An ID with all IDLength*8 bits in common is prefix itself.
+func NewRandomKademliaIDWithPrefix(prefix *KademliaID, length int) *KademliaID {
+	if length >= IDLength*8 {
+		newKademliaID := *prefix
+		return &newKademliaID
+	}
+
+	newKademliaID := *NewRandomKademliaID()
+
+	for i := 0; i < length/8; i++ { // whole bytes of the prefix
+		newKademliaID[i] = prefix[i]
+	}
+	i, bit := length/8, byte(0x80)>>(length%8)
+	mask := ^(bit<<1 - 1) // the bits of the prefix in the byte where it ends
+	newKademliaID[i] = prefix[i]&mask | ^prefix[i]&bit | newKademliaID[i]&(bit-1)
+	return &newKademliaID
+}
+
+// CommonPrefixLength returns the number of leading bits kademliaID and otherKademliaID have in common
+func (kademliaID KademliaID) CommonPrefixLength(otherKademliaID *KademliaID) int {
+	for i := 0; i < IDLength; i++ {
+		if b := kademliaID[i] ^ otherKademliaID[i]; b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return IDLength * 8
+}
+
 // Less returns true if kademliaID < otherKademliaID (bitwise)
 func (kademliaID KademliaID) Less(otherKademliaID *KademliaID) bool {
 	for i := 0; i < IDLength; i++ {
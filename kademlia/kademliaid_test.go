@@ -79,3 +79,29 @@ func TestKademliaIdString(t *testing.T) {
 		t.Fatalf("The returned string is incorrect! \n%s != %s", id, corr)
 	}
 }
+
+func TestNewRandomKademliaIDWithPrefix(t *testing.T) {
+	prefix := NewKademliaID("FFFFFFFF00000000000000000000000000000000")
+
+	for _, length := range []int{0, 1, 7, 8, 13, 32, 100, IDLength*8 - 1, IDLength * 8} {
+		for i := 0; i < 20; i++ { // the bits after the prefix are random
+			id := NewRandomKademliaIDWithPrefix(prefix, length)
+			if common := id.CommonPrefixLength(prefix); common != length {
+				t.Fatalf("The ID %s has %d bits in common with the prefix instead of %d!", id, common, length)
+			}
+		}
+	}
+}
+
+func TestKademliaIdCommonPrefixLength(t *testing.T) {
+	id1 := NewKademliaID("FFFFFFFF00000000000000000000000000000000")
+	id2 := NewKademliaID("FFFFFFFE00000000000000000000000000000000")
+	id3 := NewKademliaID("7FFFFFFF00000000000000000000000000000000")
+
+	if id1.CommonPrefixLength(id2) != 31 || id2.CommonPrefixLength(id1) != 31 {
+		t.Fatalf("Incorrect common prefix length! %d", id1.CommonPrefixLength(id2))
+	}
+	if id1.CommonPrefixLength(id3) != 0 || id1.CommonPrefixLength(id1) != IDLength*8 {
+		t.Fatalf("Incorrect common prefix length!")
+	}
+}
@@ -1,93 +1,192 @@
 package kademlia
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 )
 
-const timeout = 5 * time.Second
-
 // interfaces and structs for Messenger
 type Messenger interface {
 	SendMessage(contact *Contact, msg Message)
 }
 
 type UDPMessenger struct {
-	Rt *RoutingTable
+	Rt         ContactTable
+	PacketSize int               // messages larger than this are sent over TCP or split into fragments
+	TCP        *TCPMessenger     // used for messages that do not fit in a single packet, fragments are sent if nil or it fails
+	Codec      Codec             // wire format of sent messages, defaults to BinaryCodec
+	Identity   *Identity         // signs every sent message if set
+	Prefer     AddressPreference // family that is dialed when a contact has addresses in both
 }
 
 type MockMessenger struct {
-	Rt       *RoutingTable
+	Rt       ContactTable
 	Messages []Message
+	lock     sync.Mutex
 }
 
 type Network struct {
-	Rt                *RoutingTable
+	Rt                ContactTable
 	BootstrapIP       string
 	ListenPort        string
 	PacketSize        int
+	UDPOnly           bool                          // Start does not listen for TCP connections
 	ExpectedResponses map[KademliaID](chan Message) // map of RPCID : message channel used by handler
+	expectedPeers     map[KademliaID]expectedPeer   // map of RPCID : contact the request was sent to
 	lock              sync.Mutex
 	Messenger         Messenger
+	fragments         *reassembler            // collects fragments of messages larger than a packet
+	ValuesDir         string                  // directory where stored values are kept, defaults to kademlia/values
+	Codec             Codec                   // wire format of received messages, defaults to BinaryCodec
+	invalidPackets    map[string]int          // map of source IP : number of dropped packets
+	RetryPolicies     map[string]RetryPolicy  // map of message type : retry policy, DefaultRetryPolicies if nil
+	Identity          *Identity               // keypair of this node, if set unsigned messages are rejected
+	encrypted         bool                    // plaintext messages other than handshakes are rejected, see EnableEncryption
+	sessionCache      *sessionCache           // negotiated sessions for encrypted messages
+	udpConn           *net.UDPConn            // socket of the running network, nil if it is not started
+	tcpListener       net.Listener            // listener of the running network, nil if it is not started
+	tcpConns          map[net.Conn]bool       // accepted connections, closed together with the network
+	done              chan struct{}           // closed when the network is closed
+	closed            bool                    // Close was called and the network has not been started since
+	serving           sync.WaitGroup          // goroutines reading from the socket and listener
+	observedVotes     map[string]string       // map of peer IP : IP of this node as seen by the peer
+	RateLimits        map[string]RateLimit    // map of message type : limit per source IP, DefaultRateLimits if nil
+	Workers           int                     // messages handled at the same time, DefaultWorkers if 0
+	QueueSize         int                     // messages of each kind waiting for a worker, DefaultQueueSize if 0
+	queues            *workQueues             // queues of the workers, started with the first message
+	rateBuckets       *lruCache[*tokenBucket] // map of source IP and message type : tokens left
+	droppedPackets    map[string]int          // map of reason : number of valid packets that were dropped
+	verifiedSources   *lruCache[struct{}]     // source IPs that were seen receiving our packets, the least recent are dropped first
+	pendingReplies    int                     // responses waiting for their source to be verified
+	verifying         map[string]bool         // addresses of the other family of senders that are being pinged
+}
+
+var (
+	ErrNetworkClosed  = errors.New("NETWORK ERROR: the network is closed")
+	ErrNetworkRunning = errors.New("NETWORK ERROR: the network is already started")
+)
+
+// a messenger that keeps connections open, they are closed together with the network
+type closer interface {
+	Close()
 }
 
 type Message struct {
-	MsgType  string
-	Sender   Contact
-	Body     string
-	Key      KademliaID
-	RPCID    KademliaID
-	Contacts []Contact
+	MsgType       string
+	Sender        Contact
+	Body          string
+	Key           KademliaID
+	RPCID         KademliaID
+	Contacts      []Contact
+	PublicKey     []byte // public key of the sender, its hash is the sender ID
+	Signature     []byte // signature of the sender over the rest of the message
+	Observed      string // in responses, the address the request was received from
+	replyLimit    int    // largest response that may be sent to an unverified sender, 0 if there is no limit
+	authenticated bool   // the signature was verified when the message was received
 }
 
-// send generic message over UDP
+// Close closes the cached TCP connections
+func (m *UDPMessenger) Close() {
+	if m.TCP != nil {
+		m.TCP.Close()
+	}
+}
+
+// send generic message over UDP. Messages that do not fit in a packet are sent over TCP, or split
+// into fragments if there is no TCP messenger or the contact can not be reached over TCP.
 func (m *UDPMessenger) SendMessage(contact *Contact, msg Message) {
 	log.Println("Sending message: ", msg.MsgType)
 	// make sure the sender field is always this node
-	msg.Sender = m.Rt.me
+	msg.Sender = m.Rt.Me()
 
-	// set up the connection
-	udpAddr, err := net.ResolveUDPAddr("udp", contact.Address)
+	if m.Identity != nil { // sign the message so the receiver knows it is really from us
+		if err := m.Identity.Sign(&msg); err != nil {
+			log.Println("SIGNATURE ERROR:", err)
+			return
+		}
+	}
+
+	data, err := codecOrDefault(m.Codec).Encode(msg) // encode
 	if err != nil {
-		log.Fatal("SETUP ERROR:", err)
+		log.Println("ENCODE ERROR:", err)
+		return
 	}
 
-	conn, err := net.DialUDP("udp", nil, udpAddr)
+	packetSize := m.PacketSize
+	if packetSize == 0 {
+		packetSize = DefaultPacketSize
+	}
+
+	address, err := contact.DialAddress(m.Prefer)
 	if err != nil {
-		log.Fatal("DAIL ERROR:", err)
+		log.Println("SETUP ERROR:", err)
+		return
 	}
 
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf) // encoded bytes go to buf
+	packets := [][]byte{data}
+	if len(data) > packetSize { // too big for a single packet
+		if m.TCP != nil {
+			err := m.TCP.send(address, data)
+			if err == nil {
+				return
+			}
+			log.Println("TCP ERROR:", err, "sending fragments instead") // the contact may only use UDP
+		}
+
+		fragments, err := splitFragments(msg.RPCID, data, packetSize)
+		if err != nil {
+			log.Println("FRAGMENT ERROR:", err)
+			return
+		}
+		packets = fragments
+	}
 
-	if err := enc.Encode(msg); err != nil { // encode
-		log.Fatal("ENCODE ERROR:", err)
+	// set up the connection
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		log.Println("SETUP ERROR:", err)
+		return
 	}
 
-	_, err = conn.Write(buf.Bytes()) // send encoded message
-	for err != nil {
-		// log.Println("WRITE ERROR:", err)
-		// a write error occured, this can happen in networks with a lot of activity
-		// wait 50 milliseconds and try again
-		time.Sleep(50 * time.Millisecond)
-		_, err = conn.Write(buf.Bytes())
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		log.Println("DAIL ERROR:", err)
+		return
+	}
+	defer conn.Close()
+
+	for _, packet := range packets {
+		_, err = conn.Write(packet) // send encoded message
+		for err != nil {
+			// log.Println("WRITE ERROR:", err)
+			// a write error occured, this can happen in networks with a lot of activity
+			// wait 50 milliseconds and try again
+			time.Sleep(50 * time.Millisecond)
+			_, err = conn.Write(packet)
+		}
 	}
 }
 
 // Mock version of send message. Used for testing
 func (m *MockMessenger) SendMessage(_ *Contact, msg Message) {
-	msg.Sender = m.Rt.me
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	msg.Sender = m.Rt.Me()
 	m.Messages = append(m.Messages, msg)
 }
 
 // Get latest message from mock version of send message
 func (m *MockMessenger) GetLatestMessage() (Message, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	if len(m.Messages) == 0 {
 		return Message{}, fmt.Errorf("MOCK MESSAGE ERROR: There are no more messages! Returning empty message")
 	}
@@ -98,101 +197,514 @@ func (m *MockMessenger) GetLatestMessage() (Message, error) {
 	return mes, nil
 }
 
-// Keep listening in a loop and handle received messages.
+// Keep listening in a loop and handle received messages until the network is closed.
+// Large messages are received over TCP.
 func (network *Network) Listen() {
-	ListenAddr, err := net.ResolveUDPAddr("udp", ":"+network.ListenPort)
-	if err != nil {
+	if err := network.Start(); err != nil {
 		log.Fatal(err)
 	}
+	<-network.closing()
+}
+
+// Start listening on ListenPort for UDP packets and TCP connections in the background, only for
+// UDP packets if UDPOnly is set.
+// Both IPv4 and IPv6 are received on the port if the host supports them.
+// If ListenPort is "0" a free port is picked and ListenPort is set to it.
+// A closed network can be started again.
+func (network *Network) Start() error {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	if network.udpConn != nil {
+		return ErrNetworkRunning
+	}
 
-	// start listening
-	conn, err := net.ListenUDP("udp", ListenAddr)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: parsePort(network.ListenPort)})
 	if err != nil {
-		log.Fatal(err) // TODO: unsure how to handle the errors should i return them or log.Fatal(err)
+		return err
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	// TCP uses the same port, so senders only need to know one
+	var listener net.Listener
+	if !network.UDPOnly {
+		listener, err = net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	if network.ListenPort != strconv.Itoa(port) { // a port was picked, advertise it in both families
+		network.ListenPort = strconv.Itoa(port)
+		me := network.Rt.Me()
+		for _, address := range me.AllAddresses() {
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				network.Rt.SetAddress(net.JoinHostPort(host, network.ListenPort))
+			}
+		}
+	}
+	network.udpConn = conn
+	network.tcpListener = listener
+	if network.closed { // waiters of the last run have been cancelled, start over
+		network.done = nil
+		network.closed = false
+	}
+
+	network.serving.Add(1)
+	go func() {
+		defer network.serving.Done()
+		network.serveUDP(conn)
+	}()
+	if listener != nil {
+		network.serving.Add(1)
+		go func() {
+			defer network.serving.Done()
+			network.acceptTCP(listener)
+		}()
 	}
-	defer conn.Close() // close connection when listening is done
+	return nil
+}
+
+// Close stops listening, closes all connections and makes every request that is waiting for a
+// response return ErrNetworkClosed. Requests sent after Close fail until the network is started again.
+func (network *Network) Close() error {
+	network.lock.Lock()
+	conn, listener := network.udpConn, network.tcpListener
+	network.udpConn, network.tcpListener = nil, nil
+	for c := range network.tcpConns {
+		c.Close()
+	}
+	network.tcpConns = nil
+	if !network.closed {
+		if network.done == nil {
+			network.done = make(chan struct{})
+		}
+		close(network.done) // wake up every waiting request and stop the workers
+		network.closed = true
+	}
+	network.queues = nil // messages that were not handled yet are dropped
+	fragments := network.fragments
+	network.lock.Unlock()
+
+	var err error
+	if conn != nil {
+		err = conn.Close()
+	}
+	if listener != nil {
+		listener.Close()
+	}
+	if fragments != nil {
+		fragments.Clear()
+	}
+	if c, ok := network.Messenger.(closer); ok {
+		c.Close()
+	}
+
+	network.serving.Wait()
+	return err
+}
+
+// returns a channel that is closed when the network is closed
+func (network *Network) closing() <-chan struct{} {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	if network.done == nil {
+		network.done = make(chan struct{})
+	}
+	return network.done
+}
+
+// the port number of port, 0 if it is empty or not a number
+func parsePort(port string) int {
+	n, _ := strconv.Atoi(port)
+	return n
+}
 
-	// read messages in a loop
+// read packets from conn in a loop until it is closed, fragments are reassembled before they are handled
+func (network *Network) serveUDP(conn *net.UDPConn) {
+	network.lock.Lock()
+	if network.fragments == nil {
+		network.fragments = newReassembler(fragmentTimeout)
+	}
+	fragments := network.fragments
+	network.lock.Unlock()
+
+	// room for the largest UDP packet, peers may use a larger PacketSize than this node
+	buf := make([]byte, maxUDPPacketSize)
 	for {
-		buf := make([]byte, network.PacketSize)
 		n, addr, err := conn.ReadFromUDP(buf[0:]) // place read message in buf
-		if err != nil {
-			log.Fatal("ERROR 1:", err)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil { // a failed read only affects this packet, keep listening
+			log.Println("READ ERROR:", err)
+			continue
 		}
 
-		dec := gob.NewDecoder(bytes.NewBuffer(buf[:n])) // give message as input to decoder
-		var decoded_message Message
-		if err := dec.Decode(&decoded_message); err != nil { //place the decoded message in decoded_message
-			log.Fatal("ERROR 2:", err)
+		data := append([]byte(nil), buf[:n]...) // buf is reused for the next packet
+		if isFragment(data) {
+			if !network.allow(addr.IP.String(), "FRAGMENT") { // before the fragment takes up memory
+				network.countDropped(dropRateLimit)
+				continue
+			}
+			var complete bool
+			data, complete = fragments.Add(addr.String(), data)
+			if !complete { // wait for the rest of the fragments
+				continue
+			}
 		}
 
-		decoded_message.Sender.Address = addr.IP.String() + ":" + network.ListenPort // ensure the sender has the correct IP
+		network.handlePacket(data, addr.IP)
+	}
+}
+
+// decode a received message sent from ip and give it to the handler
+func (network *Network) handlePacket(data []byte, ip net.IP) {
+	source := ip.String()
+	decoded_message, err := codecOrDefault(network.Codec).Decode(data)
+	if err == nil && !network.allow(source, decoded_message.MsgType) { // before the signature is checked, that is expensive
+		network.countDropped(dropRateLimit)
+		return
+	}
+	if err == nil {
+		err = network.checkMessage(decoded_message)
+	}
+	sealed := decoded_message.MsgType == "SEALED"
+	if err == nil {
+		decoded_message, err = network.unseal(decoded_message)
+	}
+	if err != nil { // not a message we understand or can trust, drop it
+		log.Println("Dropping packet from", ip, err)
+		network.countInvalid(source)
+		return
+	}
+
+	if sealed { // only a peer that received our handshake can seal messages
+		network.markVerified(source)
+		if !network.allow(source, decoded_message.MsgType) {
+			network.countDropped(dropRateLimit)
+			return
+		}
+	}
+	decoded_message.authenticated = len(decoded_message.Signature) > 0 // signatures are always checked when present
+	if !network.isVerified(source) {
+		decoded_message.replyLimit = amplificationFactor * len(data)
+	}
+
+	advertised := decoded_message.Sender
+	decoded_message.Sender.Address = network.senderAddress(advertised.Address, ip) // ensure the sender has the correct IP
+	decoded_message.Sender.AltAddress = ""
+	if ipv6, ok := addressFamily(decoded_message.Sender.Address); ok { // keep what it advertised for the other family once it answered
+		if alt := advertised.addressOfFamily(!ipv6); alt != "" && network.isVerified(sourceOf(alt)) {
+			decoded_message.Sender.AltAddress = alt
+		} else if alt != "" {
+			network.verifyAltAddress(decoded_message.Sender, alt)
+		}
+	}
+
+	log.Println("received message: ", decoded_message.MsgType) // for debugging
 
-		log.Println("received message: ", decoded_message.MsgType) // for debugging
+	if !network.enqueue(decoded_message) { // give received message to the workers, unless they are too far behind
+		network.countDropped(dropQueueFull)
+	}
+}
+
+// the address a sender can be reached at: the IP the message was received from, which is the only
+// part that can be observed, and the port the sender advertised. Senders that do not advertise a
+// port are expected to listen on the same port as this node.
+func (network *Network) senderAddress(advertised string, ip net.IP) string {
+	port := network.ListenPort
+	if _, p, err := net.SplitHostPort(advertised); err == nil && parsePort(p) > 0 {
+		port = p
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
 
-		go network.MessageHandler(decoded_message) //give received message to the handler
+// decode a packet and check that it can be handled and trusted
+func (network *Network) readPacket(data []byte) (Message, error) {
+	msg, err := codecOrDefault(network.Codec).Decode(data)
+	if err == nil {
+		err = network.checkMessage(msg)
 	}
+	return msg, err
 }
 
-// handles received messages based on the message type and tries adding the sender to the routing table
+// check that a decoded message can be handled and trusted
+func (network *Network) checkMessage(msg Message) error {
+	if err := validateMessage(msg); err != nil {
+		return err
+	}
+	return network.verifySignature(msg)
+}
+
+// handles received messages based on the message type and queues the sender to be added to the routing table
 func (network *Network) MessageHandler(received_message Message) {
+	if err := validateMessage(received_message); err != nil {
+		log.Println("Dropping message:", err)
+		return
+	}
+
 	switch received_message.MsgType {
 	case "PING":
-		go network.SendPongMessage(received_message)
+		network.SendPongMessage(received_message)
 	case "FIND_CONTACT":
-		go network.SendFindContactResponse(received_message)
+		network.SendFindContactResponse(received_message)
 	case "FIND_DATA":
-		go network.SendFindDataResponse(received_message)
+		network.SendFindDataResponse(received_message)
 	case "STORE":
-		go network.SendStoreResponse(received_message)
-	case "PONG", "FIND_CONTACT_RESPONSE", "FIND_DATA_RESPONSE", "STORE_RESPONSE":
-		go network.handleResponse(received_message)
+		network.SendStoreResponse(received_message)
+	case "HANDSHAKE":
+		network.SendHandshakeResponse(received_message)
+	case "PONG", "FIND_CONTACT_RESPONSE", "FIND_DATA_RESPONSE", "STORE_RESPONSE", "HANDSHAKE_RESPONSE":
+		network.handleResponse(received_message)
 	}
 	sender := received_message.Sender
-	sender.CalcDistance(network.Rt.me.ID)
-	network.Rt.AddContact(sender, network.SendPingMessage)
+	sender.CalcDistance(network.Rt.Me().ID)
+	network.queueContact(sender)
+}
+
+// validateMessage returns an error if msg could not be handled safely
+func validateMessage(msg Message) error {
+	if _, ok := messageTypes[msg.MsgType]; !ok {
+		return fmt.Errorf("INVALID MESSAGE: unknown message type %q", msg.MsgType)
+	}
+	if msg.Sender.ID == nil {
+		return fmt.Errorf("INVALID MESSAGE: the sender has no ID")
+	}
+	for _, contact := range msg.Contacts {
+		if contact.ID == nil || contact.Address == "" {
+			return fmt.Errorf("INVALID MESSAGE: contact without ID or address")
+		}
+	}
+	return nil
+}
+
+// check the signature of msg before anything in it is trusted. Signed messages always have to be
+// valid, unsigned messages are only accepted by nodes without an identity.
+func (network *Network) verifySignature(msg Message) error {
+	if len(msg.Signature) == 0 && network.Identity == nil {
+		return nil
+	}
+	return VerifyMessage(msg)
+}
+
+// count a dropped packet against source
+func (network *Network) countInvalid(source string) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	if network.invalidPackets == nil {
+		network.invalidPackets = make(map[string]int)
+	}
+	network.invalidPackets[source]++
+}
+
+// InvalidPackets returns the number of packets from the source IP that were dropped because they were invalid
+func (network *Network) InvalidPackets(source string) int {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	return network.invalidPackets[source]
 }
 
-// Give a response message to a waiting sender
+// Give a response message to a waiting sender. A response to a request sent by SendAndAwaitResponseContext
+// is only accepted from the contact the request was sent to, anyone else knowing the RPCID is spoofing.
 func (network *Network) handleResponse(response Message) {
 	network.lock.Lock()
 	chn := network.ExpectedResponses[response.RPCID] // grab the channel of the waiting sender
-	if chn != nil {
-		chn <- response // give response to the waiting channel
-		close(chn)      // clean up
-		delete(network.ExpectedResponses, response.RPCID)
+	peer, pinned := network.expectedPeers[response.RPCID]
+	network.lock.Unlock()
+
+	if chn == nil {
+		return
+	}
+	if pinned && !respondedBy(&peer, response) {
+		log.Println("Possible spoofing: response from", response.Sender.Address, response.Sender.ID, "to a request sent to", peer.contact.Address, peer.contact.ID)
+		network.countInvalid(sourceOf(response.Sender.Address))
+		return
 	}
+
+	network.lock.Lock()
+	if network.ExpectedResponses[response.RPCID] != chn { // another response was faster
+		network.lock.Unlock()
+		return
+	}
+	delete(network.ExpectedResponses, response.RPCID) // clean up, later duplicates of the response are ignored
+	delete(network.expectedPeers, response.RPCID)
 	network.lock.Unlock()
+
+	network.markVerified(sourceOf(response.Sender.Address)) // it received our request
+	network.recordObserved(response)                        // only solicited responses get a vote on our address
+	chn <- response                                         // give response to the waiting channel
+}
+
+// the contact a request was sent to, with its addresses resolved when the request was sent
+type expectedPeer struct {
+	contact   Contact
+	addresses []string // the addresses of contact, a hostname is replaced by the IPs it resolves to
+}
+
+// resolve the addresses of contact once, so the responses to a request do not each need a DNS query
+func newExpectedPeer(ctx context.Context, contact Contact) expectedPeer {
+	peer := expectedPeer{contact: contact}
+	for _, address := range contact.AllAddresses() {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || net.ParseIP(host) != nil {
+			peer.addresses = append(peer.addresses, address)
+			continue
+		}
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host) // a hostname, such as the bootstrap node
+		if err != nil {
+			log.Println("Could not resolve", host, err)
+		}
+		for _, ip := range ips {
+			peer.addresses = append(peer.addresses, net.JoinHostPort(ip.IP.String(), port))
+		}
+	}
+	return peer
+}
+
+// respondedBy reports whether response comes from the peer a request was sent to. The ID has to
+// match if it is known, and the response has to come from the IP of one of the addresses of the peer.
+// Ports are only compared when the ID is not known, a node behind a NAT advertises another port than
+// the one it is reached at, but without an ID the address is all that identifies the peer.
+// A dual stack node may answer over the other address family, which is only trusted if it signed the response.
+func respondedBy(peer *expectedPeer, response Message) bool {
+	sender, contact := response.Sender, peer.contact
+	if contact.ID != nil && (sender.ID == nil || *contact.ID != *sender.ID) {
+		return false
+	}
+	if respondedFrom(peer.addresses, sender, contact.ID == nil) {
+		return true
+	}
+	return contact.ID != nil && response.authenticated
+}
+
+// respondedFrom reports whether sender was received from the IP of one of addresses, and from its port if comparePort
+func respondedFrom(addresses []string, sender Contact, comparePort bool) bool {
+	senderHost, senderPort, senderErr := net.SplitHostPort(sender.Address)
+	senderIP := net.ParseIP(senderHost)
+	for _, address := range addresses {
+		if address == sender.Address {
+			return true
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || senderErr != nil || senderIP == nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.Equal(senderIP) && (!comparePort || port == senderPort) {
+			return true
+		}
+	}
+	return false
 }
 
 // Send message to contact and await a response. Times out if nothing is received.
 func (network *Network) SendAndAwaitResponse(contact *Contact, message Message) Message {
-	response := make(chan Message) // channel for receiving a response to the sent message
+	response, _ := network.SendAndAwaitResponseContext(context.Background(), contact, message)
+	return response
+}
+
+// Send message to contact and await a response until ctx is done or the request times out.
+// Unanswered requests are sent again as given by the retry policy of the message type.
+// If no response is received a TIMEOUT message is returned together with the reason.
+func (network *Network) SendAndAwaitResponseContext(ctx context.Context, contact *Contact, message Message) (Message, error) {
+	return network.sendAndAwait(ctx, contact, message, network.retryPolicy(message.MsgType))
+}
+
+// send message to contact and await a response, retrying as given by policy
+func (network *Network) sendAndAwait(ctx context.Context, contact *Contact, message Message, policy RetryPolicy) (Message, error) {
+	response := make(chan Message, 1) // channel for receiving a response to the sent message
+	closing := network.closing()
+	timedOut := Message{MsgType: "TIMEOUT", RPCID: message.RPCID}
 
+	select {
+	case <-closing:
+		return timedOut, ErrNetworkClosed
+	default:
+	}
+
+	peer := newExpectedPeer(ctx, *contact)
 	network.lock.Lock()
 	network.ExpectedResponses[message.RPCID] = response // "subscribe" to receive a response
+	if network.expectedPeers == nil {
+		network.expectedPeers = make(map[KademliaID]expectedPeer)
+	}
+	network.expectedPeers[message.RPCID] = peer // only the contact may respond
 	network.lock.Unlock()
 
-	network.Messenger.SendMessage(contact, message)
-
-	select {
-	case read := <-response: // got a response
-		return read
-	case <-time.After(timeout): // no response
-		network.lock.Lock() // remove the expected response
-		chn := network.ExpectedResponses[message.RPCID]
-		if chn != nil {
-			close(chn)
+	defer func() { // remove the expected response if it is still there
+		network.lock.Lock()
+		if network.ExpectedResponses[message.RPCID] == response {
 			delete(network.ExpectedResponses, message.RPCID)
+			delete(network.expectedPeers, message.RPCID)
 		}
 		network.lock.Unlock()
-		log.Println("Time out while waiting for message: ", message.RPCID)
-		return Message{MsgType: "TIMEOUT", RPCID: message.RPCID}
+	}()
+
+	for attempt := 0; ; attempt++ {
+		// wait as long as the round trip times measured to the contact suggest
+		timeoutCtx, cancel := context.WithTimeout(ctx, network.Rt.Timeout(contact))
+
+		// negotiating a session is part of the attempt, so the caller does not wait for it after giving up
+		sent := time.Now()
+		if err := network.ensureSession(timeoutCtx, contact, message.MsgType); err != nil {
+			log.Println("SESSION ERROR: could not negotiate a session with", contact.Address, err)
+		} else {
+			sent = time.Now()
+			network.Messenger.SendMessage(contact, message)
+		}
+
+		select {
+		case read := <-response: // got a response
+			cancel()
+			if attempt == 0 { // a response to a retry could belong to any attempt, so it can not be timed
+				network.Rt.RecordRTT(contact, time.Since(sent))
+			}
+			return read, nil
+		case <-timeoutCtx.Done(): // no response, or the caller gave up
+			cancel()
+		case <-closing:
+			cancel()
+			return timedOut, ErrNetworkClosed
+		}
+
+		if ctx.Err() != nil {
+			log.Println("Stopped waiting for message: ", message.RPCID, ctx.Err())
+			return timedOut, ctx.Err()
+		}
+
+		// the contact did not respond in time, it may also have lost our session
+		network.Rt.RecordTimeout(contact)
+		network.forgetSession(contact.Address)
+		if attempt >= policy.Retries {
+			log.Println("Time out while waiting for message: ", message.RPCID)
+			return timedOut, context.DeadlineExceeded
+		}
+
+		// back off before the next attempt, a late response is still accepted
+		select {
+		case read := <-response:
+			return read, nil
+		case <-time.After(policy.delay(attempt)):
+		case <-ctx.Done():
+			return timedOut, ctx.Err()
+		case <-closing:
+			return timedOut, ErrNetworkClosed
+		}
+		log.Println("Retrying message: ", message.RPCID)
 	}
 }
 
 // Send ping message to contact and wait for a response that is given in out.
 func (network *Network) SendPingMessage(contact *Contact, out chan Message) {
+	response, _ := network.PingContext(context.Background(), contact) // send message, get a response or a timeout
+	out <- response                                                   // return the response through the out channel
+}
+
+// Send ping message to contact and wait for a response until ctx is done.
+func (network *Network) PingContext(ctx context.Context, contact *Contact) (Message, error) {
 	// make the message
 	ID := *NewRandomKademliaID()
 	m := Message{
@@ -200,21 +712,27 @@ func (network *Network) SendPingMessage(contact *Contact, out chan Message) {
 		RPCID:   ID,
 	}
 
-	response := network.SendAndAwaitResponse(contact, m) // send message, get a response or a timeout
-	out <- response                                      // return the response through the out channel
+	return network.SendAndAwaitResponseContext(ctx, contact, m)
 }
 
 // Send pong response to the subject message.
 func (network *Network) SendPongMessage(subject Message) {
 	m := Message{
-		MsgType: "PONG",
-		RPCID:   subject.RPCID,
+		MsgType:  "PONG",
+		RPCID:    subject.RPCID,
+		Observed: subject.Sender.Address,
 	}
-	network.Messenger.SendMessage(&subject.Sender, m)
+	network.reply(subject, m)
 }
 
 // Ask contact about id, receive response in out channel.
 func (network *Network) SendFindContactMessage(id KademliaID, contact *Contact, out chan Message) {
+	response, _ := network.FindContactContext(context.Background(), id, contact) // send message, get a response or a timeout
+	out <- response                                                              // return the response through the out channel
+}
+
+// Ask contact about id and wait for the response until ctx is done.
+func (network *Network) FindContactContext(ctx context.Context, id KademliaID, contact *Contact) (Message, error) {
 	// create the message
 	ID := *NewRandomKademliaID()
 	m := Message{
@@ -223,24 +741,30 @@ func (network *Network) SendFindContactMessage(id KademliaID, contact *Contact,
 		Key:     id,
 	}
 
-	response := network.SendAndAwaitResponse(contact, m) // send message, get a response or a timeout
-	out <- response                                      // return the response through the out channel
+	return network.SendAndAwaitResponseContext(ctx, contact, m)
 }
 
 // Send a find contact response to the subject message.
 func (network *Network) SendFindContactResponse(subject Message) {
-	closest := network.Rt.FindClosestContactsExclude(&subject.Key, bucketSize, *subject.Sender.ID)
+	closest := network.Rt.FindClosestContactsExclude(&subject.Key, network.Rt.K(), *subject.Sender.ID)
 
 	m := Message{
 		MsgType:  "FIND_CONTACT_RESPONSE",
 		RPCID:    subject.RPCID,
 		Contacts: closest,
+		Observed: subject.Sender.Address,
 	}
-	network.Messenger.SendMessage(&subject.Sender, m)
+	network.reply(subject, m)
 }
 
 // Ask contact if they have the data associated with hash, put response in out.
 func (network *Network) SendFindDataMessage(hash KademliaID, contact *Contact, out chan Message) {
+	response, _ := network.FindDataContext(context.Background(), hash, contact) // send message, get a response or a timeout
+	out <- response                                                             // return the response through the out channel
+}
+
+// Ask contact if they have the data associated with hash and wait for the response until ctx is done.
+func (network *Network) FindDataContext(ctx context.Context, hash KademliaID, contact *Contact) (Message, error) {
 	ID := *NewRandomKademliaID()
 	m := Message{
 		MsgType: "FIND_DATA",
@@ -248,18 +772,18 @@ func (network *Network) SendFindDataMessage(hash KademliaID, contact *Contact, o
 		Key:     hash,
 	}
 
-	response := network.SendAndAwaitResponse(contact, m) // send message, get a response or a timeout
-	out <- response                                      // return the response through the out channel
+	return network.SendAndAwaitResponseContext(ctx, contact, m)
 }
 
 // Send a find data response to the subject message.
 func (network *Network) SendFindDataResponse(subject Message) {
-	closest := network.Rt.FindClosestContactsExclude(&subject.Key, bucketSize, *subject.Sender.ID)
+	closest := network.Rt.FindClosestContactsExclude(&subject.Key, network.Rt.K(), *subject.Sender.ID)
 
 	m := Message{
 		MsgType:  "FIND_DATA_RESPONSE",
 		RPCID:    subject.RPCID,
 		Contacts: closest,
+		Observed: subject.Sender.Address,
 	}
 
 	// find data
@@ -268,12 +792,12 @@ func (network *Network) SendFindDataResponse(subject Message) {
 		m.Body = res
 	}
 
-	network.Messenger.SendMessage(&subject.Sender, m)
+	network.reply(subject, m)
 }
 
 func (network *Network) FindData(key string) (string, error) {
 	fmt.Println("filename:", key)
-	path := "kademlia/values/" + key
+	path := network.valuePath(key)
 	res, err := os.ReadFile(path)
 
 	if err != nil {
@@ -301,12 +825,22 @@ func (network *Network) SendStoreMessage(key KademliaID, data []byte, contact *C
 
 func (network *Network) SendStoreResponse(subject Message) {
 	// store data
-	path := "kademlia/values/" + subject.Key.String()
+	path := network.valuePath(subject.Key.String())
 	err := os.WriteFile(path, []byte(subject.Body), 0666)
 
 	if err != nil {
-		log.Fatal(err)
+		log.Println("STORE ERROR:", err)
+		return
 	}
 
 	fmt.Println("Values saved!")
 }
+
+// path of the file that holds the value stored under key
+func (network *Network) valuePath(key string) string {
+	dir := network.ValuesDir
+	if dir == "" {
+		dir = "kademlia/values"
+	}
+	return filepath.Join(dir, key)
+}
@@ -1,6 +1,11 @@
 package kademlia
 
 import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -510,7 +515,7 @@ func TestMessageHandler(t *testing.T) {
 		RPCID:   *id,
 	}
 
-	responseCh := make(chan Message)
+	responseCh := make(chan Message, 1) // the handler does not wait for the receiver
 	n.ExpectedResponses[*id] = responseCh
 
 	n.MessageHandler(m)
@@ -521,3 +526,469 @@ func TestMessageHandler(t *testing.T) {
 		t.Fatalf("MessageHandler does not handle PONG message correctly!")
 	}
 }
+
+func TestValidateMessage(t *testing.T) {
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+
+	if err := validateMessage(Message{MsgType: "PING", Sender: me}); err != nil {
+		t.Fatalf("A valid message was rejected! %s", err)
+	}
+
+	invalid := []Message{
+		{MsgType: "NOT_A_TYPE", Sender: me},
+		{MsgType: "PING", Sender: Contact{Address: "127.0.0.1:1234"}},
+		{MsgType: "FIND_CONTACT_RESPONSE", Sender: me, Contacts: []Contact{{Address: "127.0.0.1:1234"}}},
+		{MsgType: "FIND_CONTACT_RESPONSE", Sender: me, Contacts: []Contact{{ID: me.ID}}},
+	}
+	for _, m := range invalid {
+		if err := validateMessage(m); err == nil {
+			t.Fatalf("An invalid message was accepted! %+v", m)
+		}
+	}
+}
+
+func TestHandlePacketDropsInvalid(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	source := net.IPv4(127, 0, 0, 2)
+
+	// garbage, a truncated packet and a message from a sender without an ID
+	valid, _ := BinaryCodec{}.Encode(Message{MsgType: "PING", Sender: me})
+	noSender, _ := BinaryCodec{}.Encode(Message{MsgType: "PING"})
+	for _, packet := range [][]byte{[]byte("garbage"), valid[:len(valid)-1], noSender} {
+		n.handlePacket(packet, source)
+	}
+
+	if count := n.InvalidPackets(source.String()); count != 3 {
+		t.Fatalf("The invalid packets were not counted! %d != 3", count)
+	}
+
+	// test that the node still handles valid packets
+	n.handlePacket(valid, source)
+	if _, err := n.Messenger.(*MockMessenger).GetLatestMessage(); err != nil {
+		time.Sleep(10 * time.Millisecond)
+		if _, err := n.Messenger.(*MockMessenger).GetLatestMessage(); err != nil {
+			t.Fatalf("A valid packet was not handled after invalid packets were received!")
+		}
+	}
+	if count := n.InvalidPackets(source.String()); count != 3 {
+		t.Fatalf("A valid packet was counted as invalid!")
+	}
+}
+
+// the handler should never crash, no matter what is received
+func FuzzHandlePacket(f *testing.F) {
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+		ValuesDir:         f.TempDir(),
+	}
+
+	for _, m := range []Message{
+		{MsgType: "PING", Sender: me},
+		{MsgType: "FIND_CONTACT", Sender: me, Key: *me.ID},
+		{MsgType: "STORE", Sender: me, Body: "value"},
+		codecTestMessage(),
+	} {
+		data, _ := BinaryCodec{}.Encode(m)
+		f.Add(data)
+	}
+	f.Add([]byte{})
+	f.Add([]byte("garbage"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		n.handlePacket(data, net.IPv4(127, 0, 0, 2))
+	})
+}
+
+// messages decoded with gob can contain nil IDs anywhere, the handler has to survive them
+func FuzzMessageHandler(f *testing.F) {
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+		ValuesDir:         f.TempDir(),
+	}
+
+	for _, m := range []Message{
+		{MsgType: "PING", Sender: me},
+		{MsgType: "PING"},
+		{MsgType: "FIND_CONTACT_RESPONSE", Sender: me, Contacts: []Contact{{Address: "127.0.0.1:1234"}}},
+		{MsgType: "FIND_DATA", Sender: Contact{Address: "127.0.0.1:1234"}},
+		codecTestMessage(),
+	} {
+		data, _ := GobCodec{}.Encode(m)
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := GobCodec{}.Decode(data)
+		if err != nil {
+			return
+		}
+		n.MessageHandler(m)
+	})
+}
+
+func TestSendAndAwaitResponseContext(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	// test that a cancelled request returns right away
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	res, err := n.SendAndAwaitResponseContext(ctx, &me, Message{RPCID: *NewRandomKademliaID()})
+	if err != context.Canceled || res.MsgType != "TIMEOUT" {
+		t.Fatalf("A cancelled request should return the cancellation! %v", err)
+	}
+	if time.Since(start) > DefaultTimeout/2 {
+		t.Fatalf("The cancelled request kept waiting for the full timeout!")
+	}
+
+	// test that the deadline of the context is honored
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = n.PingContext(ctx, &me)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("A request past its deadline should return the deadline error! %v", err)
+	}
+
+	// test that no expected responses are left behind
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if len(n.ExpectedResponses) != 0 {
+		t.Fatalf("The expected responses were not cleaned up! %d left", len(n.ExpectedResponses))
+	}
+}
+
+func TestStartClose(t *testing.T) {
+	k := newTestKademlia(t, NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:0"))
+	n := k.Network
+	n.ListenPort = "0"
+
+	if err := n.Start(); err != nil {
+		t.Fatalf("Could not start network: %s", err)
+	}
+	if n.ListenPort == "0" {
+		t.Fatalf("The picked port was not set!")
+	}
+	if err := n.Start(); err != ErrNetworkRunning {
+		t.Fatalf("A running network was started twice!")
+	}
+	self := NewContact(n.Rt.Me().ID, "127.0.0.1:"+n.ListenPort)
+
+	// test that a waiting request is cancelled when the network is closed
+	waiting := make(chan error)
+	go func() {
+		_, err := n.PingContext(context.Background(), &Contact{Address: "127.0.0.1:9"}) // nobody answers
+		waiting <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := n.Close(); err != nil {
+		t.Fatalf("Could not close network: %s", err)
+	}
+	select {
+	case err := <-waiting:
+		if err != ErrNetworkClosed {
+			t.Fatalf("The waiting request failed with the wrong error! %v", err)
+		}
+	case <-time.After(DefaultTimeout):
+		t.Fatalf("The waiting request was not cancelled!")
+	}
+
+	// test that requests fail while the network is closed
+	if _, err := n.PingContext(context.Background(), &self); err != ErrNetworkClosed {
+		t.Fatalf("A request was sent on a closed network! %v", err)
+	}
+
+	// test that the network can be started again
+	if err := n.Start(); err != nil {
+		t.Fatalf("Could not restart network: %s", err)
+	}
+	defer n.Close()
+	if res, err := n.PingContext(context.Background(), &self); err != nil || res.MsgType != "PONG" {
+		t.Fatalf("The restarted network did not answer! %v", err)
+	}
+}
+
+func TestCloseTCPConnections(t *testing.T) {
+	k := newTestKademlia(t, NewContact(NewRandomKademliaID(), "127.0.0.1:0"))
+	n := k.Network
+	n.ListenPort = "0"
+	if err := n.Start(); err != nil {
+		t.Fatalf("Could not start network: %s", err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+n.ListenPort)
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err)
+	}
+	defer conn.Close()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		n.lock.Lock()
+		accepted := len(n.tcpConns) == 1
+		n.lock.Unlock()
+		if accepted {
+			break
+		}
+	}
+
+	// test that Close closes the served connection and waits until it is no longer served
+	if err := n.Close(); err != nil {
+		t.Fatalf("Could not close network: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("The connection was not closed by Close! %v", err)
+	}
+	if len(n.tcpConns) != 0 {
+		t.Fatalf("A connection was still served after Close! %d", len(n.tcpConns))
+	}
+
+	// test that a connection accepted while Close runs is closed too
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer listener.Close()
+	late, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err)
+	}
+	defer late.Close()
+	n.acceptTCP(listener) // the network is closed, so it returns after the first connection
+	late.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := late.Read(make([]byte, 1)); err != io.EOF || len(n.tcpConns) != 0 {
+		t.Fatalf("A connection accepted after Close was kept open! %v", err)
+	}
+}
+
+func TestStartCloseMany(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		k := newTestKademlia(t, NewContact(NewRandomKademliaID(), "127.0.0.1:0"))
+		k.Network.ListenPort = "0"
+		if err := k.Start(); err != nil {
+			t.Fatalf("Could not start node %d: %s", i, err)
+		}
+		self := NewContact(k.Rt.Me().ID, "127.0.0.1:"+k.Network.ListenPort)
+		if res, err := k.Network.PingContext(context.Background(), &self); err != nil || res.MsgType != "PONG" {
+			t.Fatalf("Node %d did not answer! %v", i, err)
+		}
+		if err := k.Close(); err != nil {
+			t.Fatalf("Could not close node %d: %s", i, err)
+		}
+	}
+
+	// test that the closed nodes left no goroutines behind, handlers may take a moment to finish
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before+2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before+2 {
+		t.Fatalf("Closed nodes left goroutines behind! %d > %d", after, before)
+	}
+}
+
+func TestSenderAddress(t *testing.T) {
+	var n = Network{ListenPort: "1234"}
+	ip := net.IPv4(10, 0, 0, 1)
+
+	for advertised, expected := range map[string]string{
+		"127.0.0.1:4000": "10.0.0.1:4000", // the observed IP wins over the advertised one
+		"10.0.0.1:4001":  "10.0.0.1:4001",
+		"10.0.0.1":       "10.0.0.1:1234", // no port advertised
+		"":               "10.0.0.1:1234",
+		"10.0.0.1:0":     "10.0.0.1:1234",
+	} {
+		if address := n.senderAddress(advertised, ip); address != expected {
+			t.Fatalf("The sender address of %q was %s instead of %s!", advertised, address, expected)
+		}
+	}
+
+	if address := n.senderAddress("[::1]:4000", net.IPv6loopback); address != "[::1]:4000" {
+		t.Fatalf("The IPv6 sender address was not joined correctly! %s", address)
+	}
+}
+
+func TestNodesOnOneHost(t *testing.T) {
+	var nodes []*Kademlia
+	for i := 0; i < 3; i++ {
+		k := newTestKademlia(t, NewContact(NewRandomKademliaID(), "127.0.0.1:0"))
+		if err := k.Start(); err != nil {
+			t.Fatalf("Could not start node: %s", err)
+		}
+		defer k.Close()
+		nodes = append(nodes, k)
+	}
+
+	// test that every node can reach every other node on the same IP
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a == b {
+				continue
+			}
+			if res, err := a.Network.PingContext(context.Background(), contactOf(b)); err != nil || res.MsgType != "PONG" || *res.Sender.ID != *b.Rt.Me().ID {
+				t.Fatalf("%s did not answer %s! %v", b.Rt.Me().Address, a.Rt.Me().Address, err)
+			}
+		}
+	}
+
+	// test that the routing table keeps the port of each node
+	time.Sleep(10 * time.Millisecond)
+	for _, b := range nodes[1:] {
+		closest := nodes[0].Rt.FindClosestContacts(b.Rt.Me().ID, 1)
+		if len(closest) != 1 || closest[0].Address != b.Rt.Me().Address {
+			t.Fatalf("The routing table does not have the address of %s! %v", b.Rt.Me().Address, closest)
+		}
+	}
+}
+
+func TestHandleResponseChecksPeer(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var other = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "192.0.2.7:4321")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	id := *NewRandomKademliaID()
+	responses := make(chan Message, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		res, _ := n.SendAndAwaitResponseContext(ctx, &other, Message{MsgType: "PING", RPCID: id})
+		responses <- res
+	}()
+	for _, err := n.Messenger.(*MockMessenger).GetLatestMessage(); err != nil; _, err = n.Messenger.(*MockMessenger).GetLatestMessage() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a response with the right RPCID from another node, and from the right ID at another IP
+	n.handleResponse(Message{MsgType: "PONG", RPCID: id, Sender: NewContact(NewKademliaID("2FFFFFFF00000000000000000000000000000000"), "192.0.2.7:4321")})
+	n.handleResponse(Message{MsgType: "PONG", RPCID: id, Sender: NewContact(other.ID, "192.0.2.8:4321")})
+	if n.InvalidPackets("192.0.2.7") != 1 || n.InvalidPackets("192.0.2.8") != 1 {
+		t.Fatalf("The spoofed responses were not counted against their senders!")
+	}
+
+	// test that the real response is still accepted, even from another port
+	n.handleResponse(Message{MsgType: "PONG", RPCID: id, Sender: NewContact(other.ID, "192.0.2.7:5555")})
+	if res := <-responses; res.MsgType != "PONG" || res.Sender.Address != "192.0.2.7:5555" {
+		t.Fatalf("The response of the contact was not accepted! %+v", res)
+	}
+}
+
+func TestRespondedBy(t *testing.T) {
+	id := NewKademliaID("1FFFFFFF00000000000000000000000000000000")
+	dualStack := Contact{ID: id, Address: "127.0.0.1:1234", AltAddress: "[::1]:1234"}
+
+	tests := []struct {
+		contact  Contact
+		response Message
+		expected bool
+	}{
+		{dualStack, Message{Sender: Contact{ID: id, Address: "[::1]:4321"}}, true},
+		{dualStack, Message{Sender: Contact{ID: id, Address: "127.0.0.2:1234"}}, false},
+		{dualStack, Message{Sender: Contact{ID: id, Address: "127.0.0.2:1234"}, authenticated: true}, true}, // the signature proves the ID
+		{dualStack, Message{Sender: Contact{ID: NewRandomKademliaID(), Address: "127.0.0.1:1234"}}, false},
+		{Contact{Address: "localhost:1234"}, Message{Sender: Contact{ID: id, Address: "127.0.0.1:1234"}}, true},  // the ID of the bootstrap node is not known
+		{Contact{Address: "localhost:1234"}, Message{Sender: Contact{ID: id, Address: "127.0.0.1:4321"}}, false}, // then the port has to match too
+		{Contact{Address: "127.0.0.1:1234"}, Message{Sender: Contact{ID: id, Address: "127.0.0.1:4321"}}, false},
+		{Contact{Address: "127.0.0.1:1234"}, Message{Sender: Contact{ID: id, Address: "127.0.0.2:1234"}, authenticated: true}, false},
+		{Contact{ID: id, Address: "node-1"}, Message{Sender: Contact{ID: id, Address: "node-1"}}, true}, // addresses of the SimNetwork
+	}
+	for _, test := range tests {
+		peer := newExpectedPeer(context.Background(), test.contact)
+		if respondedBy(&peer, test.response) != test.expected {
+			t.Fatalf("A response from %v to a request sent to %v was not judged correctly!", test.response.Sender, test.contact)
+		}
+	}
+}
+
+func TestReceiveLargerPacket(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var other = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "127.0.0.1:1235")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer conn.Close()
+	go n.serveUDP(conn)
+
+	// a peer with a larger packet size sends the message in a single packet
+	messenger := &UDPMessenger{Rt: NewRoutingTable(other), PacketSize: 8192}
+
+	id := *NewRandomKademliaID()
+	responseCh := make(chan Message)
+	n.lock.Lock()
+	n.ExpectedResponses[id] = responseCh
+	n.lock.Unlock()
+
+	target := NewContact(me.ID, conn.LocalAddr().String())
+	body := strings.Repeat("c", 4096)
+	messenger.SendMessage(&target, Message{MsgType: "FIND_DATA_RESPONSE", RPCID: id, Body: body})
+
+	select {
+	case res := <-responseCh:
+		if res.Body != body {
+			t.Fatalf("The packet was not received whole!")
+		}
+	case <-time.After(DefaultTimeout):
+		t.Fatalf("A packet larger than the packet size of the node was never received!")
+	}
+}
@@ -0,0 +1,91 @@
+package kademlia
+
+import (
+	"log"
+	"net"
+)
+
+// only the latest report of this many peers is kept
+const maxObservedVotes = 64
+
+// the address of this node is only changed once this many peers agree on it
+const minObservedVotes = 2
+
+// count the address a peer reported to have received our request from. Every peer IP has one
+// vote, and once a strict majority of the peers that reached us over the same address family
+// agrees on an IP that differs from our own address of that family, our address is changed to it.
+// The port is kept, only the IP can be observed.
+func (network *Network) recordObserved(response Message) {
+	observed, _, err := net.SplitHostPort(response.Observed)
+	ipv6, ok := addressFamily(response.Observed)
+	if err != nil || !ok {
+		return
+	}
+	peer, _, err := net.SplitHostPort(response.Sender.Address)
+	if err != nil {
+		return
+	}
+
+	network.lock.Lock()
+	if network.observedVotes == nil {
+		network.observedVotes = make(map[string]string)
+	}
+	if _, ok := network.observedVotes[peer]; !ok && len(network.observedVotes) >= maxObservedVotes {
+		for other := range network.observedVotes { // make room by dropping any other vote
+			delete(network.observedVotes, other)
+			break
+		}
+	}
+	network.observedVotes[peer] = observed
+
+	family := make(map[string]string) // votes of the same family
+	for peer, ip := range network.observedVotes {
+		if other, _ := addressFamily(net.JoinHostPort(ip, "0")); other == ipv6 {
+			family[peer] = ip
+		}
+	}
+	winner, ok := majority(family)
+	network.lock.Unlock()
+	if !ok {
+		return
+	}
+
+	me := network.Rt.Me()
+	current := me.addressOfFamily(ipv6)
+	host, port, err := net.SplitHostPort(current)
+	if err != nil { // no address of this family yet, advertise the port we listen on
+		port = network.ListenPort
+	} else if net.ParseIP(host).Equal(net.ParseIP(winner)) {
+		return
+	}
+
+	address := net.JoinHostPort(winner, port)
+	log.Println("Peers see this node at", address, "instead of", current)
+	network.Rt.SetAddress(address)
+}
+
+// returns the IP that has a strict majority of the votes, and at least minObservedVotes of them
+func majority(votes map[string]string) (string, bool) {
+	counts := make(map[string]int)
+	for _, ip := range votes {
+		counts[ip]++
+	}
+	for ip, count := range counts {
+		if count >= minObservedVotes && 2*count > len(votes) {
+			return ip, true
+		}
+	}
+	return "", false
+}
+
+// ObservedAddresses returns how many peers reported each IP as the address of this node
+func (network *Network) ObservedAddresses() map[string]int {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	counts := make(map[string]int)
+	for _, ip := range network.observedVotes {
+		counts[ip]++
+	}
+	return counts
+}
@@ -0,0 +1,97 @@
+package kademlia
+
+import (
+	"testing"
+)
+
+func TestMajority(t *testing.T) {
+	if _, ok := majority(map[string]string{"10.0.0.1": "192.0.2.1"}); ok {
+		t.Fatalf("A single vote should not be enough!")
+	}
+	if ip, ok := majority(map[string]string{"10.0.0.1": "192.0.2.1", "10.0.0.2": "192.0.2.1", "10.0.0.3": "192.0.2.2"}); !ok || ip != "192.0.2.1" {
+		t.Fatalf("The majority was not found! %s", ip)
+	}
+	if _, ok := majority(map[string]string{"10.0.0.1": "192.0.2.1", "10.0.0.2": "192.0.2.1", "10.0.0.3": "192.0.2.2", "10.0.0.4": "192.0.2.2"}); ok {
+		t.Fatalf("A tie should not be a majority!")
+	}
+}
+
+func TestRecordObserved(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "10.0.0.5:4000")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "4000",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	response := func(peer string, observed string) Message {
+		return Message{MsgType: "PONG", Sender: NewContact(NewRandomKademliaID(), peer), Observed: observed}
+	}
+
+	// test that one peer can not change the address
+	n.recordObserved(response("10.0.0.1:1234", "192.0.2.1:1234"))
+	n.recordObserved(response("10.0.0.1:1235", "192.0.2.1:1234")) // same IP, so the same vote
+	if rt.Me().Address != "10.0.0.5:4000" {
+		t.Fatalf("The address was changed by a single peer! %s", rt.Me().Address)
+	}
+
+	// test that the address follows the majority, keeping the port
+	n.recordObserved(response("10.0.0.2:1234", "192.0.2.1:1234"))
+	if rt.Me().Address != "192.0.2.1:4000" {
+		t.Fatalf("The address was not changed to the observed address! %s", rt.Me().Address)
+	}
+	if counts := n.ObservedAddresses(); counts["192.0.2.1"] != 2 {
+		t.Fatalf("The votes were not counted! %v", counts)
+	}
+
+	// test that invalid reports are ignored
+	n.recordObserved(response("10.0.0.3:1234", "not an address"))
+	n.recordObserved(response("10.0.0.4:1234", ""))
+	if counts := n.ObservedAddresses(); len(counts) != 1 {
+		t.Fatalf("Invalid reports were counted! %v", counts)
+	}
+}
+
+func TestObservedInResponse(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var other = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "192.0.2.7:4321")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	n.SendPongMessage(Message{MsgType: "PING", RPCID: *NewRandomKademliaID(), Sender: other})
+	n.SendFindContactResponse(Message{MsgType: "FIND_CONTACT", RPCID: *NewRandomKademliaID(), Sender: other})
+	n.SendFindDataResponse(Message{MsgType: "FIND_DATA", RPCID: *NewRandomKademliaID(), Sender: other})
+
+	for _, res := range n.Messenger.(*MockMessenger).Messages {
+		if res.Observed != other.Address {
+			t.Fatalf("The %s did not report the observed address! %q", res.MsgType, res.Observed)
+		}
+	}
+
+	// test that unsolicited responses get no vote
+	n.handleResponse(Message{MsgType: "PONG", RPCID: *NewRandomKademliaID(), Sender: other, Observed: "192.0.2.1:1234"})
+	if len(n.ObservedAddresses()) != 0 {
+		t.Fatalf("An unsolicited response was counted!")
+	}
+}
+
+func TestLocalIP(t *testing.T) {
+	if ip := LocalIP(); ip == nil || ip.IsUnspecified() {
+		t.Fatalf("No local IP was found! %v", ip)
+	}
+}
@@ -0,0 +1,232 @@
+package kademlia
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// files in Config.DataDir
+const (
+	identityFile = "identity.json"
+	contactsFile = "contacts.json"
+)
+
+// the identity as it is saved, the keypair is derived from the seed again when it is loaded
+type savedIdentity struct {
+	Seed  string `json:"seed"`            // hex of the ed25519 seed
+	Nonce string `json:"nonce,omitempty"` // hex of the solution of the dynamic puzzle
+}
+
+// a contact as it is saved in the snapshot of the routing table
+type savedContact struct {
+	ID         string `json:"id"`
+	Address    string `json:"address"`
+	AltAddress string `json:"alt_address,omitempty"`
+	Nonce      string `json:"nonce,omitempty"`
+}
+
+// LoadOrCreateIdentity returns the identity saved in dir, so a restarted node keeps its ID.
+// If there is none a new identity that solves puzzle is created and saved.
+func LoadOrCreateIdentity(dir string, puzzle Puzzle) (*Identity, error) {
+	data, err := os.ReadFile(filepath.Join(dir, identityFile))
+	if errors.Is(err, os.ErrNotExist) {
+		identity, err := NewIdentityForPuzzle(puzzle)
+		if err != nil {
+			return nil, err
+		}
+		return identity, SaveIdentity(dir, identity)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var saved savedIdentity
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("PERSIST ERROR: invalid %s: %w", identityFile, err)
+	}
+	seed, err := hex.DecodeString(saved.Seed)
+	if err != nil {
+		return nil, fmt.Errorf("PERSIST ERROR: invalid seed: %w", err)
+	}
+	identity, err := NewIdentityFromSeed(seed)
+	if err != nil {
+		return nil, err
+	}
+	if identity.Nonce, err = decodeOptionalID(saved.Nonce); err != nil {
+		return nil, err
+	}
+
+	// the puzzle of the deployment may have become harder since the identity was saved
+	if err := puzzle.Check(identity.Contact("")); err != nil {
+		return nil, fmt.Errorf("PERSIST ERROR: the saved identity does not solve the puzzle: %w", err)
+	}
+	return identity, nil
+}
+
+// SaveIdentity saves identity in dir, readable only by the owner as it holds the private key
+func SaveIdentity(dir string, identity *Identity) error {
+	saved := savedIdentity{Seed: hex.EncodeToString(identity.PrivateKey.Seed())}
+	if identity.Nonce != nil {
+		saved.Nonce = identity.Nonce.String()
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, identityFile), data, 0600)
+}
+
+// SaveContacts saves a snapshot of the contacts in the routing table to Config.DataDir.
+// Nothing is saved if there is no data directory.
+func (kademlia *Kademlia) SaveContacts() error {
+	if kademlia.Config.DataDir == "" {
+		return nil
+	}
+
+	saved := []savedContact{}
+	for _, bucket := range kademlia.Rt.Buckets() {
+		for _, contact := range bucket.Contacts {
+			s := savedContact{ID: contact.ID.String(), Address: contact.Address, AltAddress: contact.AltAddress}
+			if contact.Nonce != nil {
+				s.Nonce = contact.Nonce.String()
+			}
+			saved = append(saved, s)
+		}
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(kademlia.Config.DataDir, contactsFile), data, 0644)
+}
+
+// LoadContacts returns the contacts of the last snapshot saved in dir, none if there is no snapshot
+func LoadContacts(dir string) ([]Contact, error) {
+	data, err := os.ReadFile(filepath.Join(dir, contactsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var saved []savedContact
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("PERSIST ERROR: invalid %s: %w", contactsFile, err)
+	}
+	contacts := make([]Contact, 0, len(saved))
+	for _, s := range saved {
+		id, err := decodeOptionalID(s.ID)
+		if err != nil || id == nil {
+			return nil, fmt.Errorf("PERSIST ERROR: invalid contact ID %q", s.ID)
+		}
+		contact := NewContact(id, s.Address)
+		contact.AltAddress = s.AltAddress
+		if contact.Nonce, err = decodeOptionalID(s.Nonce); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, nil
+}
+
+// SnapshotLoop saves the contacts every Config.Snapshot until the network is closed
+func (kademlia *Kademlia) SnapshotLoop() {
+	if kademlia.Config.DataDir == "" {
+		return
+	}
+	ticker := time.NewTicker(kademlia.Config.Snapshot)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := kademlia.SaveContacts(); err != nil {
+				log.Println("PERSIST ERROR:", err)
+			}
+		case <-kademlia.Network.closing():
+			return
+		}
+	}
+}
+
+// rejoin pings the contacts of the last snapshot in parallel and adds the ones that respond.
+// Returns false if none of them is alive, then the node has to join through the bootstrap node.
+func (kademlia *Kademlia) rejoin(ctx context.Context) bool {
+	if kademlia.Config.DataDir == "" {
+		return false
+	}
+	contacts, err := LoadContacts(kademlia.Config.DataDir)
+	if err != nil {
+		log.Println("Not rejoining:", err)
+		return false
+	}
+
+	log.Println("Rejoining through", len(contacts), "saved contacts")
+	ctx, cancel := context.WithTimeout(ctx, kademlia.Config.Timeout) // dead contacts are not retried
+	defer cancel()
+
+	var wg sync.WaitGroup
+	alive := make(chan Contact, len(contacts))
+	for _, contact := range contacts {
+		wg.Add(1)
+		go func(contact Contact) {
+			defer wg.Done()
+			if r, err := kademlia.Network.PingContext(ctx, &contact); err == nil && r.MsgType == "PONG" {
+				alive <- r.Sender
+			}
+		}(contact)
+	}
+	wg.Wait()
+	close(alive)
+
+	rejoined := false
+	for contact := range alive {
+		kademlia.Rt.AddContact(contact, kademlia.Network.SendPingMessage)
+		rejoined = true
+	}
+	return rejoined
+}
+
+// the KademliaID encoded as hex in s, nil if s is empty
+func decodeOptionalID(s string) (*KademliaID, error) {
+	if s == "" {
+		return nil, nil
+	}
+	decoded, err := hex.DecodeString(s)
+	if err != nil || len(decoded) != IDLength {
+		return nil, fmt.Errorf("PERSIST ERROR: invalid ID %q", s)
+	}
+	id := KademliaID(decoded)
+	return &id, nil
+}
+
+// write data to a temporary file that replaces path, so a crash never leaves half a file behind
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails once it has been renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,105 @@
+package kademlia
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	dir := t.TempDir()
+	puzzle := Puzzle{Static: 2, Dynamic: 2}
+
+	created, err := LoadOrCreateIdentity(dir, puzzle)
+	if err != nil {
+		t.Fatalf("Could not create the identity: %s", err)
+	}
+
+	// test that a restarted node gets the same identity back, with the solution of its puzzle
+	loaded, err := LoadOrCreateIdentity(dir, puzzle)
+	if err != nil || *loaded.ID() != *created.ID() || !loaded.PrivateKey.Equal(created.PrivateKey) || *loaded.Nonce != *created.Nonce {
+		t.Fatalf("The saved identity was not loaded! %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, identityFile)); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("The private key can be read by others! %v", err)
+	}
+
+	// test that a saved identity that does not solve the puzzle is not used
+	if _, err := LoadOrCreateIdentity(dir, Puzzle{Static: 8 * IDLength}); err == nil {
+		t.Fatalf("An identity that does not solve the puzzle was loaded!")
+	}
+	os.WriteFile(filepath.Join(dir, identityFile), []byte("{"), 0600)
+	if _, err := LoadOrCreateIdentity(dir, puzzle); err == nil {
+		t.Fatalf("An invalid identity file was loaded!")
+	}
+}
+
+func TestSaveContacts(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var dir = t.TempDir()
+	var sim = NewSimNetwork(1)
+	var node, _ = sim.AddNodeWithConfig(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "a"), Config{DataDir: dir})
+	var dualStack = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "127.0.0.1:8001")
+	/*-----------------------------------------------------------------------------------------------*/
+
+	dualStack.AltAddress = "[::1]:8001"
+	dualStack.Nonce = NewRandomKademliaID()
+	node.Rt.AddContact(dualStack, pingTest)
+	node.Rt.AddContact(NewContact(NewKademliaID("2FFFFFFF00000000000000000000000000000000"), "127.0.0.1:8002"), pingTest)
+
+	// test that there is nothing to load before the first snapshot
+	if contacts, err := LoadContacts(dir); err != nil || len(contacts) != 0 {
+		t.Fatalf("Contacts were loaded without a snapshot! %v %v", contacts, err)
+	}
+
+	if err := node.SaveContacts(); err != nil {
+		t.Fatalf("Could not save the contacts: %s", err)
+	}
+	contacts, err := LoadContacts(dir)
+	if err != nil || len(contacts) != 2 {
+		t.Fatalf("The saved contacts were not loaded! %v %v", contacts, err)
+	}
+	for _, contact := range contacts {
+		if *contact.ID == *dualStack.ID && (contact.Address != dualStack.Address || contact.AltAddress != dualStack.AltAddress || *contact.Nonce != *dualStack.Nonce) {
+			t.Fatalf("The contact was not saved completely! %+v", contact)
+		}
+	}
+}
+
+func TestWarmRestart(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var dir = t.TempDir()
+	var sim = NewSimNetwork(1)
+	var config = Config{DataDir: dir, Timeout: minRTO}
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "a")
+	var alive = sim.AddNode(NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "b"))
+	var bootstrap = sim.AddNode(NewContact(NewKademliaID("2FFFFFFF00000000000000000000000000000000"), "c"))
+	var dead = NewContact(NewKademliaID("3FFFFFFF00000000000000000000000000000000"), "dead")
+	/*-----------------------------------------------------------------------------------------------*/
+
+	before, _ := sim.AddNodeWithConfig(me, config)
+	before.Rt.AddContact(alive.Rt.Me(), pingTest)
+	before.Rt.AddContact(dead, pingTest)
+	before.Close()
+
+	// test that the restarted node rejoins through the saved contact that is alive, not the bootstrap node
+	after, _ := sim.AddNodeWithConfig(me, config)
+	after.Network.BootstrapIP = bootstrap.Rt.Me().Address
+	after.JoinNetwork()
+	contacts := after.Rt.FindClosestContacts(me.ID, 20)
+	if len(contacts) != 1 || *contacts[0].ID != *alive.Rt.Me().ID {
+		t.Fatalf("The node did not rejoin through the saved contact that is alive! %v", contacts)
+	}
+
+	// test that the bootstrap node is used when no saved contact is alive
+	sim.Remove(alive.Rt.Me().Address)
+	restarted, _ := sim.AddNodeWithConfig(me, config)
+	restarted.Network.BootstrapIP = bootstrap.Rt.Me().Address
+	restarted.JoinNetwork()
+	contacts = restarted.Rt.FindClosestContacts(bootstrap.Rt.Me().ID, 1)
+	if len(contacts) != 1 || *contacts[0].ID != *bootstrap.Rt.Me().ID {
+		t.Fatalf("The node did not fall back to the bootstrap node! %v", contacts)
+	}
+}
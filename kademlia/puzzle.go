@@ -0,0 +1,124 @@
+package kademlia
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"math/bits"
+)
+
+// Puzzle is the crypto puzzle every node ID has to solve before it is accepted, as in S/Kademlia.
+// Solving a puzzle takes about 2^Static key generations and 2^Dynamic hashes, checking it
+// takes a single hash each, so creating many IDs for a Sybil attack becomes expensive.
+//
+//	static:  SHA-1(ID) has at least Static leading zero bits. The ID is derived from the
+//	         public key, so the only way to solve it is to generate keys until one fits.
+//	dynamic: SHA-1(ID xor Nonce) has at least Dynamic leading zero bits. The nonce is sent
+//	         along with the contact.
+//
+// The zero value accepts every ID.
+type Puzzle struct {
+	Static  int // difficulty of the static puzzle in bits
+	Dynamic int // difficulty of the dynamic puzzle in bits
+}
+
+var (
+	ErrStaticPuzzle  = errors.New("PUZZLE ERROR: ID does not solve the static puzzle")
+	ErrDynamicPuzzle = errors.New("PUZZLE ERROR: nonce does not solve the dynamic puzzle")
+	ErrPuzzleTooHard = errors.New("PUZZLE ERROR: difficulty is out of range")
+)
+
+// Check returns an error unless contact solves the puzzle
+func (puzzle Puzzle) Check(contact Contact) error {
+	if puzzle.Static > 0 && (contact.ID == nil || leadingZeros(sha1.Sum(contact.ID[:])) < puzzle.Static) {
+		return ErrStaticPuzzle
+	}
+	if puzzle.Dynamic > 0 && (contact.ID == nil || contact.Nonce == nil ||
+		leadingZeros(sha1.Sum(contact.ID.CalcDistance(contact.Nonce)[:])) < puzzle.Dynamic) {
+		return ErrDynamicPuzzle
+	}
+	return nil
+}
+
+// Filter returns the contacts that solve the puzzle
+func (puzzle Puzzle) Filter(contacts []Contact) []Contact {
+	if puzzle == (Puzzle{}) {
+		return contacts
+	}
+
+	valid := make([]Contact, 0, len(contacts))
+	for _, contact := range contacts {
+		if puzzle.Check(contact) == nil {
+			valid = append(valid, contact)
+		}
+	}
+	return valid
+}
+
+// NewIdentityForPuzzle generates keypairs until the ID solves the static puzzle, then solves the
+// dynamic puzzle for that ID. The solution is kept as the nonce of the identity.
+func NewIdentityForPuzzle(puzzle Puzzle) (*Identity, error) {
+	if puzzle.Static < 0 || puzzle.Static > 8*IDLength || puzzle.Dynamic < 0 || puzzle.Dynamic > 8*IDLength {
+		return nil, ErrPuzzleTooHard
+	}
+
+	for {
+		identity, err := NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		if (Puzzle{Static: puzzle.Static}).Check(NewContact(identity.ID(), "")) != nil {
+			continue
+		}
+
+		if puzzle.Dynamic > 0 {
+			if identity.Nonce, err = solveDynamic(identity.ID(), puzzle.Dynamic); err != nil {
+				return nil, err
+			}
+		}
+		return identity, nil
+	}
+}
+
+// find a nonce that solves the dynamic puzzle of id
+func solveDynamic(id *KademliaID, difficulty int) (*KademliaID, error) {
+	var nonce KademliaID
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	for leadingZeros(sha1.Sum(id.CalcDistance(&nonce)[:])) < difficulty {
+		// count upwards from the random start
+		for i := IDLength - 1; i >= 0; i-- {
+			nonce[i]++
+			if nonce[i] != 0 {
+				break
+			}
+		}
+	}
+	return &nonce, nil
+}
+
+// number of leading zero bits of hash
+func leadingZeros(hash [IDLength]byte) int {
+	for i, b := range hash {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return IDLength * 8
+}
+
+// SetPuzzle sets the puzzle that contacts have to solve before they are added to the routing table
+func (table *tableBase) SetPuzzle(puzzle Puzzle) {
+	table.meLock.Lock()
+	defer table.meLock.Unlock()
+	table.puzzle = puzzle
+}
+
+// Puzzle returns the puzzle that contacts have to solve before they are added to the routing table
+func (table *tableBase) Puzzle() Puzzle {
+	table.meLock.RLock()
+	defer table.meLock.RUnlock()
+	return table.puzzle
+}
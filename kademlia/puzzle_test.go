@@ -0,0 +1,137 @@
+package kademlia
+
+import (
+	"crypto/sha1"
+	"testing"
+)
+
+func TestLeadingZeros(t *testing.T) {
+	var hash [IDLength]byte
+	if leadingZeros(hash) != IDLength*8 {
+		t.Fatalf("A zero hash should have only leading zeros!")
+	}
+
+	hash[1] = 0x10
+	if leadingZeros(hash) != 11 {
+		t.Fatalf("The leading zeros were not counted correctly! %d != 11", leadingZeros(hash))
+	}
+}
+
+func TestPuzzle(t *testing.T) {
+	puzzle := Puzzle{Static: 4, Dynamic: 8}
+	identity, err := NewIdentityForPuzzle(puzzle)
+	if err != nil {
+		t.Fatalf("Could not solve puzzle: %s", err)
+	}
+
+	// test that the generated identity solves both puzzles
+	contact := identity.Contact("127.0.0.1:1234")
+	if err := puzzle.Check(contact); err != nil {
+		t.Fatalf("The generated identity does not solve the puzzle! %s", err)
+	}
+	if leadingZeros(sha1.Sum(contact.ID[:])) < 4 {
+		t.Fatalf("The static puzzle was not solved!")
+	}
+
+	// test that a missing or wrong nonce is rejected
+	noNonce := NewContact(contact.ID, "127.0.0.1:1234")
+	if err := puzzle.Check(noNonce); err != ErrDynamicPuzzle {
+		t.Fatalf("A contact without a nonce was accepted! %v", err)
+	}
+
+	// test that an ID that does not solve the static puzzle is rejected
+	var cheap *KademliaID
+	for cheap = NewRandomKademliaID(); leadingZeros(sha1.Sum(cheap[:])) >= 4; cheap = NewRandomKademliaID() {
+	}
+	if err := puzzle.Check(Contact{ID: cheap, Nonce: contact.Nonce}); err != ErrStaticPuzzle {
+		t.Fatalf("An ID that does not solve the static puzzle was accepted! %v", err)
+	}
+
+	// test that the zero puzzle accepts everything
+	if err := (Puzzle{}).Check(NewContact(cheap, "")); err != nil {
+		t.Fatalf("The zero puzzle rejected a contact! %s", err)
+	}
+
+	if _, err := NewIdentityForPuzzle(Puzzle{Static: -1}); err != ErrPuzzleTooHard {
+		t.Fatalf("An invalid difficulty was accepted!")
+	}
+}
+
+func TestPuzzleFilter(t *testing.T) {
+	puzzle := Puzzle{Dynamic: 4}
+	identity, _ := NewIdentityForPuzzle(puzzle)
+	valid := identity.Contact("127.0.0.1:1234")
+	invalid := NewContact(identity.ID(), "127.0.0.1:1235")
+
+	filtered := puzzle.Filter([]Contact{invalid, valid, invalid})
+	if len(filtered) != 1 || filtered[0].Address != valid.Address {
+		t.Fatalf("The contacts were not filtered! %v", filtered)
+	}
+}
+
+func TestRoutingTablePuzzle(t *testing.T) {
+	puzzle := Puzzle{Static: 2, Dynamic: 4}
+	rt := NewRoutingTable(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234"))
+	rt.SetPuzzle(puzzle)
+
+	identity, _ := NewIdentityForPuzzle(puzzle)
+	valid := identity.Contact("127.0.0.1:1235")
+
+	// test that only contacts that solve the puzzle are added
+	rt.AddContact(NewContact(valid.ID, "127.0.0.1:1236"), nil)
+	if len(rt.FindClosestContacts(valid.ID, DefaultK)) != 0 {
+		t.Fatalf("A contact that does not solve the puzzle was added!")
+	}
+
+	rt.AddContact(valid, nil)
+	if res := rt.FindClosestContacts(valid.ID, DefaultK); len(res) != 1 || res[0].Address != valid.Address {
+		t.Fatalf("A contact that solves the puzzle was not added!")
+	}
+}
+
+func TestLookupContactPuzzle(t *testing.T) {
+	puzzle := Puzzle{Dynamic: 4}
+	sim := NewSimNetwork(1)
+
+	var nodes []*Kademlia
+	for i, address := range []string{"a", "b", "c"} {
+		identity, _ := NewIdentityForPuzzle(puzzle)
+		node := sim.AddNode(identity.Contact(address))
+		if i < 2 {
+			node.Rt.SetPuzzle(puzzle)
+		}
+		nodes = append(nodes, node)
+	}
+
+	// c does not check the puzzle, so it tells a about a node that does not solve it
+	cheap := NewContact(NewKademliaID("0000000100000000000000000000000000000000"), "cheap")
+	nodes[2].Rt.AddContact(cheap, nil)
+	nodes[0].Rt.AddContact(nodes[2].Rt.Me(), nil)
+
+	closest := nodes[0].LookupContact(*cheap.ID)
+	for _, contact := range closest {
+		if contact.Address == cheap.Address {
+			t.Fatalf("A contact that does not solve the puzzle was returned by the lookup!")
+		}
+	}
+	if len(nodes[0].Rt.FindClosestContacts(cheap.ID, 10)) != 1 {
+		t.Fatalf("A contact that does not solve the puzzle was added to the routing table!")
+	}
+}
+
+func TestBinaryCodecNonce(t *testing.T) {
+	contact := NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	contact.Nonce = NewKademliaID("1111111100000000000000000000000000000000")
+
+	data, err := BinaryCodec{}.Encode(Message{MsgType: "PING", Sender: contact, Contacts: []Contact{contact}})
+	if err != nil {
+		t.Fatalf("Could not encode: %s", err)
+	}
+	msg, err := BinaryCodec{}.Decode(data)
+	if err != nil {
+		t.Fatalf("Could not decode: %s", err)
+	}
+	if msg.Sender.Nonce == nil || *msg.Sender.Nonce != *contact.Nonce || msg.Contacts[0].Nonce == nil || *msg.Contacts[0].Nonce != *contact.Nonce {
+		t.Fatalf("The nonce was not sent!")
+	}
+}
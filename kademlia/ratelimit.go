@@ -0,0 +1,317 @@
+package kademlia
+
+import (
+	"container/list"
+	"context"
+	"crypto/ed25519"
+	"log"
+	"net"
+	"time"
+)
+
+// RateLimit is a token bucket: a source may send Burst messages at once, and Rate more every second
+type RateLimit struct {
+	Rate  float64 // messages per second
+	Burst int     // messages that can be sent at once
+}
+
+// DefaultRateLimits are used by a Network that has no rate limits of its own. They are per source IP,
+// and nodes behind the same IP share them. Message types without a limit are not limited.
+var DefaultRateLimits = map[string]RateLimit{
+	"PING":                  {Rate: 50, Burst: 100},
+	"FIND_CONTACT":          {Rate: 100, Burst: 200},
+	"FIND_DATA":             {Rate: 100, Burst: 200},
+	"STORE":                 {Rate: 50, Burst: 100},
+	"HANDSHAKE":             {Rate: 20, Burst: 40},
+	"SEALED":                {Rate: 500, Burst: 1000},
+	"PONG":                  {Rate: 200, Burst: 400},
+	"FIND_CONTACT_RESPONSE": {Rate: 200, Burst: 400},
+	"FIND_DATA_RESPONSE":    {Rate: 200, Burst: 400},
+	"STORE_RESPONSE":        {Rate: 200, Burst: 400},
+	"HANDSHAKE_RESPONSE":    {Rate: 20, Burst: 40},
+	"FRAGMENT":              {Rate: 2000, Burst: 4000}, // packets of fragmented messages, before they are reassembled
+}
+
+// a response to a source that has not proven it receives packets at its address is at most this many
+// times larger than the request, so spoofed requests can not turn the node into an amplifier
+const amplificationFactor = 3
+
+// the size the signature adds to a message, see Identity.Sign
+const signatureOverhead = 2*3 + ed25519.PublicKeySize + ed25519.SignatureSize
+
+// bounds of the state kept per source, the oldest entries are dropped first
+const (
+	maxRateBuckets     = 4096
+	maxVerifiedSources = 4096
+	maxPendingReplies  = 64
+)
+
+// reasons packets are dropped, see DroppedPackets
+const (
+	dropRateLimit     = "rate limit"
+	dropQueueFull     = "queue full"
+	dropAmplification = "amplification"
+)
+
+// tokens left for a source and message type
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take a token from bucket if there is one, after adding the tokens earned since the last message
+func (bucket *tokenBucket) take(limit RateLimit, now time.Time) bool {
+	bucket.tokens = min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// get the rate limit for messages of msgType
+func (network *Network) rateLimit(msgType string) (RateLimit, bool) {
+	limits := network.RateLimits
+	if limits == nil {
+		limits = DefaultRateLimits
+	}
+	limit, ok := limits[msgType]
+	return limit, ok
+}
+
+// allow reports whether a message of msgType from source is within the rate limit, and uses up a token if it is
+func (network *Network) allow(source string, msgType string) bool {
+	limit, ok := network.rateLimit(msgType)
+	if !ok {
+		return true
+	}
+
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	if network.rateBuckets == nil {
+		network.rateBuckets = newLRUCache[*tokenBucket](maxRateBuckets)
+	}
+	key := source + " " + msgType
+	bucket, ok := network.rateBuckets.get(key)
+	if !ok { // the bucket that has been unused for the longest time is dropped, it is as good as full
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: time.Now()}
+		network.rateBuckets.put(key, bucket)
+	}
+	return bucket.take(limit, time.Now())
+}
+
+// count a packet that was dropped for reason
+func (network *Network) countDropped(reason string) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	if network.droppedPackets == nil {
+		network.droppedPackets = make(map[string]int)
+	}
+	network.droppedPackets[reason]++
+}
+
+// DroppedPackets returns how many valid packets were dropped for each reason, to protect the node
+// from floods. Invalid packets are counted by InvalidPackets.
+func (network *Network) DroppedPackets() map[string]int {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	dropped := make(map[string]int, len(network.droppedPackets))
+	for reason, count := range network.droppedPackets {
+		dropped[reason] = count
+	}
+	return dropped
+}
+
+// remember that source has proven it receives the packets sent to it
+func (network *Network) markVerified(source string) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	if network.verifiedSources == nil {
+		network.verifiedSources = newLRUCache[struct{}](maxVerifiedSources)
+	}
+	network.verifiedSources.put(source, struct{}{})
+}
+
+// isVerified reports whether source has proven it receives the packets sent to it
+func (network *Network) isVerified(source string) bool {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	return network.verifiedSources.contains(source)
+}
+
+// the host of address, which is how sources are identified
+func sourceOf(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// send response to the address subject was received from. Responses to unverified sources that are
+// larger than the replyLimit of subject are held back until the source has answered a ping, which
+// proves the request was not sent with a spoofed address. The ping is sent once and awaited in the
+// background, so the worker that handled subject is free for other messages.
+func (network *Network) reply(subject Message, response Message) {
+	to := subject.Sender
+	to.AltAddress = "" // only the observed address is checked, the other one could be anybody's
+	if subject.replyLimit == 0 || network.responseSize(response) <= subject.replyLimit || network.isVerified(sourceOf(to.Address)) {
+		network.Messenger.SendMessage(&to, response)
+		return
+	}
+
+	if !network.startPendingReply() {
+		log.Println("Dropping large response to unverified", subject.Sender.Address)
+		network.countDropped(dropAmplification)
+		return
+	}
+	go func() {
+		defer network.endPendingReply()
+
+		// no retries, a spoofed request must not make this node send more than one packet to its victim
+		ping := Message{MsgType: "PING", RPCID: *NewRandomKademliaID()}
+		if res, err := network.sendAndAwait(context.Background(), &to, ping, RetryPolicy{}); err != nil || res.MsgType != "PONG" {
+			log.Println("Dropping large response to unverified", to.Address, err)
+			network.countDropped(dropAmplification)
+			return
+		}
+		network.Messenger.SendMessage(&to, response)
+	}()
+}
+
+// ping the address sender advertised for its other family, which is only kept once it answered.
+// Until then a sender could make this node send packets to somebody else's address. The answer
+// comes from that address, so its sender is added with both addresses like any other sender.
+func (network *Network) verifyAltAddress(sender Contact, address string) {
+	if sender.ID == nil || !network.startVerifying(address) {
+		return
+	}
+	go func() {
+		defer network.endVerifying(address)
+
+		contact := Contact{ID: sender.ID, Address: address} // only the ID may answer
+		ping := Message{MsgType: "PING", RPCID: *NewRandomKademliaID()}
+		if _, err := network.sendAndAwait(context.Background(), &contact, ping, RetryPolicy{}); err != nil {
+			log.Println("Not using unverified address", address, "of", sender.Address, err)
+		}
+	}()
+}
+
+// reserve one of the pending responses for a ping of address, false if address is pinged already
+func (network *Network) startVerifying(address string) bool {
+	if !network.startPendingReply() {
+		return false
+	}
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	if network.verifying[address] {
+		network.pendingReplies--
+		return false
+	}
+	if network.verifying == nil {
+		network.verifying = make(map[string]bool)
+	}
+	network.verifying[address] = true
+	return true
+}
+
+// release a ping reserved by startVerifying
+func (network *Network) endVerifying(address string) {
+	network.lock.Lock()
+	delete(network.verifying, address)
+	network.lock.Unlock()
+	network.endPendingReply()
+}
+
+// the estimated size of response on the wire
+func (network *Network) responseSize(response Message) int {
+	response.Sender = network.Rt.Me()
+	data, err := codecOrDefault(network.Codec).Encode(response)
+	if err != nil {
+		return 0 // the messenger will fail to send it as well
+	}
+	if network.Identity != nil {
+		return len(data) + signatureOverhead
+	}
+	return len(data)
+}
+
+// reserve one of the responses that wait for their source to be verified
+func (network *Network) startPendingReply() bool {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	if network.pendingReplies >= maxPendingReplies {
+		return false
+	}
+	network.pendingReplies++
+	return true
+}
+
+// release a response reserved by startPendingReply
+func (network *Network) endPendingReply() {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	network.pendingReplies--
+}
+
+// a map of at most size entries, adding an entry to a full cache drops the least recently used one
+type lruCache[V any] struct {
+	size    int
+	order   *list.List               // entries from the most to the least recently used
+	entries map[string]*list.Element // map of key : element of order holding the entry
+}
+
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+// newLRUCache returns a new instance of an lruCache that holds at most size entries
+func newLRUCache[V any](size int) *lruCache[V] {
+	return &lruCache[V]{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get the value of key and mark it as used
+func (cache *lruCache[V]) get(key string) (V, bool) {
+	element, ok := cache.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	cache.order.MoveToFront(element)
+	return element.Value.(*lruEntry[V]).value, true
+}
+
+// contains reports whether key is in the cache, without marking it as used. It is safe on a nil cache.
+func (cache *lruCache[V]) contains(key string) bool {
+	if cache == nil {
+		return false
+	}
+	_, ok := cache.entries[key]
+	return ok
+}
+
+// put value at key and mark it as used, dropping the least recently used entry if the cache is full
+func (cache *lruCache[V]) put(key string, value V) {
+	if element, ok := cache.entries[key]; ok {
+		element.Value.(*lruEntry[V]).value = value
+		cache.order.MoveToFront(element)
+		return
+	}
+	if cache.order.Len() >= cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+	cache.entries[key] = cache.order.PushFront(&lruEntry[V]{key: key, value: value})
+}
+
+// len returns the number of entries in the cache
+func (cache *lruCache[V]) len() int {
+	return cache.order.Len()
+}
@@ -0,0 +1,307 @@
+package kademlia
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	limit := RateLimit{Rate: 10, Burst: 2}
+	now := time.Now()
+	bucket := &tokenBucket{tokens: float64(limit.Burst), last: now}
+
+	// test that a burst is allowed, but not more
+	if !bucket.take(limit, now) || !bucket.take(limit, now) {
+		t.Fatalf("The burst was not allowed!")
+	}
+	if bucket.take(limit, now) {
+		t.Fatalf("A message over the burst was allowed!")
+	}
+
+	// test that tokens are earned over time, up to the burst
+	if !bucket.take(limit, now.Add(100*time.Millisecond)) {
+		t.Fatalf("No token was earned after 100ms at 10 per second!")
+	}
+	later := now.Add(time.Hour)
+	for i := 0; i < limit.Burst; i++ {
+		if !bucket.take(limit, later) {
+			t.Fatalf("The tokens were not refilled!")
+		}
+	}
+	if bucket.take(limit, later) {
+		t.Fatalf("More tokens than the burst were earned!")
+	}
+}
+
+func TestHandlePacketRateLimit(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+		RateLimits:        map[string]RateLimit{"PING": {Rate: 0, Burst: 2}},
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	ping, _ := BinaryCodec{}.Encode(Message{MsgType: "PING", Sender: me})
+	for i := 0; i < 3; i++ {
+		n.handlePacket(ping, net.IPv4(127, 0, 0, 2))
+	}
+	if dropped := n.DroppedPackets(); dropped[dropRateLimit] != 1 {
+		t.Fatalf("The packet over the limit was not dropped! %v", dropped)
+	}
+	if n.InvalidPackets("127.0.0.2") != 0 {
+		t.Fatalf("A rate limited packet was counted as invalid!")
+	}
+
+	// test that other sources and other message types have their own limits
+	n.handlePacket(ping, net.IPv4(127, 0, 0, 3))
+	findContact, _ := BinaryCodec{}.Encode(Message{MsgType: "FIND_CONTACT", Sender: me})
+	n.handlePacket(findContact, net.IPv4(127, 0, 0, 2))
+	if dropped := n.DroppedPackets(); dropped[dropRateLimit] != 1 {
+		t.Fatalf("A packet within its own limit was dropped! %v", dropped)
+	}
+}
+
+func TestFragmentRateLimit(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+		RateLimits:        map[string]RateLimit{"FRAGMENT": {Rate: 0, Burst: 2}},
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer conn.Close()
+	go n.serveUDP(conn)
+
+	sender, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Could not dial: %s", err)
+	}
+	defer sender.Close()
+
+	// every fragment is a message of its own, so each one would take up a pending set
+	for i := 0; i < 3; i++ {
+		fragments, _ := splitFragments(*NewRandomKademliaID(), make([]byte, 800), 512)
+		sender.Write(fragments[0])
+	}
+
+	// test that the fragment over the limit is dropped before it is reassembled
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if n.DroppedPackets()[dropRateLimit] == 1 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("The fragment over the limit was not dropped! %v", n.DroppedPackets())
+		}
+	}
+	n.lock.Lock()
+	fragments := n.fragments
+	n.lock.Unlock()
+	defer fragments.Clear()
+	for deadline := time.Now().Add(time.Second); fragments.Pending() != 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("The fragments within the limit should be pending! %d", fragments.Pending())
+		}
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	cache := newLRUCache[int](2)
+	cache.put("a", 1)
+	cache.put("b", 2)
+
+	// test that using an entry keeps it, and the least recently used one is dropped
+	if value, ok := cache.get("a"); !ok || value != 1 {
+		t.Fatalf("The entry was not found! %d %v", value, ok)
+	}
+	cache.put("c", 3)
+	if cache.contains("b") || !cache.contains("a") || !cache.contains("c") || cache.len() != 2 {
+		t.Fatalf("The least recently used entry should have been dropped!")
+	}
+
+	// test that contains does not count as a use
+	cache.contains("a")
+	cache.put("d", 4)
+	if cache.contains("a") || !cache.contains("d") {
+		t.Fatalf("Checking an entry should not keep it!")
+	}
+}
+
+// a node that knows contacts with long addresses, so its responses are much larger than the requests
+func newAmplificationTestNode(t *testing.T) *Kademlia {
+	node := newTestKademlia(t, NewContact(NewRandomKademliaID(), "127.0.0.1:0"))
+	for i := 0; i < 2*DefaultK; i++ {
+		contact := NewContact(NewRandomKademliaID(), "[2001:db8:ffff:ffff:ffff:ffff:ffff:ffff]:65535")
+		contact.AltAddress = "[2001:db8:eeee:eeee:eeee:eeee:eeee:eeee]:65535"
+		node.Rt.AddContact(contact, pingTest)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatalf("Could not start node: %s", err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+func TestAmplification(t *testing.T) {
+	a := newTestKademlia(t, NewContact(NewRandomKademliaID(), "127.0.0.1:0"))
+	if err := a.Start(); err != nil {
+		t.Fatalf("Could not start node: %s", err)
+	}
+	defer a.Close()
+	b := newAmplificationTestNode(t)
+	bContact := b.Rt.Me()
+
+	// test that the large response is sent once a has answered a ping
+	res, err := a.Network.FindContactContext(context.Background(), *NewRandomKademliaID(), &bContact)
+	if err != nil || len(res.Contacts) != DefaultK {
+		t.Fatalf("The large response was not sent to the verified source! %v %v", res.Contacts, err)
+	}
+	if !b.Network.isVerified("127.0.0.1") {
+		t.Fatalf("The source was not verified!")
+	}
+
+	// test that a node that can not verify the source does not send the large response
+	c := newAmplificationTestNode(t)
+	c.Network.lock.Lock()
+	c.Network.pendingReplies = maxPendingReplies
+	c.Network.lock.Unlock()
+	cContact := c.Rt.Me()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := a.Network.FindContactContext(ctx, *NewRandomKademliaID(), &cContact); err == nil {
+		t.Fatalf("A large response was sent to an unverified source!")
+	}
+	if dropped := c.Network.DroppedPackets(); dropped[dropAmplification] != 1 {
+		t.Fatalf("The response was not counted as dropped! %v", dropped)
+	}
+
+	// test that small responses do not need a verified source
+	if res, err := a.Network.PingContext(context.Background(), &cContact); err != nil || res.MsgType != "PONG" {
+		t.Fatalf("A small response was not sent to an unverified source! %v", err)
+	}
+}
+
+func TestUnverifiedSourcePingedOnce(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var victim = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "127.0.0.2:1234")
+	var rt = NewRoutingTableWithConfig(me, Config{Timeout: minRTO})
+	var messenger = &MockMessenger{Rt: rt}
+	var n = Network{
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         messenger,
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	// a request with a spoofed address, the victim never answers the ping
+	subject := Message{MsgType: "FIND_CONTACT", RPCID: *NewRandomKademliaID(), Sender: victim, replyLimit: 1}
+	n.reply(subject, Message{MsgType: "FIND_CONTACT_RESPONSE", RPCID: subject.RPCID, Contacts: []Contact{me}})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n.lock.Lock()
+		pending := n.pendingReplies
+		n.lock.Unlock()
+		if pending == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("The ping of the unverified source never timed out!")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// test that the victim got a single ping and nothing else
+	messenger.lock.Lock()
+	defer messenger.lock.Unlock()
+	if len(messenger.Messages) != 1 || messenger.Messages[0].MsgType != "PING" {
+		t.Fatalf("The unverified source should only have been pinged once! %v", messenger.Messages)
+	}
+	if dropped := n.DroppedPackets(); dropped[dropAmplification] != 1 {
+		t.Fatalf("The response was not counted as dropped! %v", dropped)
+	}
+}
+
+// records the address every message is sent to, as the UDPMessenger picks it by default
+type addressMessenger struct {
+	sent map[string][]string // map of address : types of the messages sent to it
+	lock sync.Mutex
+}
+
+func (m *addressMessenger) SendMessage(contact *Contact, msg Message) {
+	address, _ := contact.DialAddress(PreferIPv4)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sent[address] = append(m.sent[address], msg.MsgType)
+}
+
+func TestAltAddressNotReflected(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "[2001:db8::ffff]:1234")
+	var rt = NewRoutingTableWithConfig(me, Config{Timeout: minRTO})
+	var messenger = &addressMessenger{sent: make(map[string][]string)}
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         messenger,
+	}
+	var attacker = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "[2001:db8::1]:1234")
+	/*-----------------------------------------------------------------------------------------------*/
+
+	// the attacker has proven its IPv6 address, and advertises the IPv4 address of a victim
+	n.markVerified("2001:db8::1")
+	attacker.AltAddress = "192.0.2.1:1234"
+	ping, _ := BinaryCodec{}.Encode(Message{MsgType: "PING", RPCID: *NewRandomKademliaID(), Sender: attacker})
+	n.handlePacket(ping, net.ParseIP("2001:db8::1"))
+	defer n.Close()
+
+	// test that the response goes to the observed address, and the victim only gets the ping that checks its address
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		messenger.lock.Lock()
+		responded := len(messenger.sent["[2001:db8::1]:1234"]) > 0
+		messenger.lock.Unlock()
+		if responded {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("The ping was not answered!")
+		}
+	}
+	messenger.lock.Lock()
+	defer messenger.lock.Unlock()
+	if sent := messenger.sent["[2001:db8::1]:1234"]; len(sent) != 1 || sent[0] != "PONG" {
+		t.Fatalf("The response was not sent to the observed address! %v", messenger.sent)
+	}
+	if sent := messenger.sent["192.0.2.1:1234"]; len(sent) != 1 || sent[0] != "PING" {
+		t.Fatalf("The advertised address got more than the ping that checks it! %v", messenger.sent)
+	}
+
+	// test that the unverified address is not kept
+	if closest := rt.FindClosestContacts(attacker.ID, 1); len(closest) == 1 && closest[0].AltAddress != "" {
+		t.Fatalf("The unverified address was kept! %v", closest)
+	}
+}
@@ -3,7 +3,7 @@ package kademlia
 /*import "testing"
 
 func TestNewRest(t *testing.T) {
-	var lKademlia = NewKademlia(NewContact(NewRandomKademliaID(), ""))
+	var lKademlia = newTestKademlia(t, NewContact(NewRandomKademliaID(), ""))
 
 	var lRest = newRest(lKademlia)
 	var lRestType interface{} = lRest
@@ -25,7 +25,7 @@ func TestGetObject(t *testing.T) {
 
 func TestCreateObject(t *testing.T) {
 	// create kademlia environment for test
-	var lKademlia1 = NewKademlia(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:8000"))
+	var lKademlia1 = newTestKademlia(t, NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:8000"))
 	lKademlia1.Rt.AddContact(NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "127.0.0.1:8001"))
 	lKademlia1.Rt.AddContact(NewContact(NewKademliaID("2FFFFFFF00000000000000000000000000000000"), "127.0.0.1:8002"))
 	// var lKademlia2 = NewKademlia(NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "127.0.0.1:8001"))
@@ -0,0 +1,43 @@
+package kademlia
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy says how often and how fast an unanswered request is sent again.
+// Every retry is sent with the same RPCID, so a late response to an earlier attempt still counts.
+type RetryPolicy struct {
+	Retries   int           // number of times the request is sent again after the first attempt
+	BaseDelay time.Duration // wait before the first retry, doubled for every later retry
+	MaxDelay  time.Duration // upper bound of the wait between two attempts
+	Jitter    float64       // fraction of the wait that is random, 0.5 waits between 50% and 150% of the delay
+}
+
+// DefaultRetryPolicies are used by a Network that has no retry policies of its own.
+// Message types without a policy are only sent once.
+var DefaultRetryPolicies = map[string]RetryPolicy{
+	"PING": {Retries: 2, BaseDelay: 100 * time.Millisecond, MaxDelay: 1 * time.Second, Jitter: 0.5},
+}
+
+// delay returns how long to wait before the given retry, the first retry is 0
+func (policy RetryPolicy) delay(retry int) time.Duration {
+	delay := policy.BaseDelay << retry
+	if delay > policy.MaxDelay || delay < policy.BaseDelay { // capped, or shifted out of range
+		delay = policy.MaxDelay
+	}
+
+	if policy.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * policy.Jitter * float64(delay))
+	}
+	return max(delay, 0)
+}
+
+// get the retry policy for messages of msgType
+func (network *Network) retryPolicy(msgType string) RetryPolicy {
+	policies := network.RetryPolicies
+	if policies == nil {
+		policies = DefaultRetryPolicies
+	}
+	return policies[msgType]
+}
@@ -0,0 +1,100 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{Retries: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+
+	// test exponential growth up to the maximum
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for i, e := range expected {
+		if d := policy.delay(i); d != e {
+			t.Fatalf("Wrong delay before retry %d! %s != %s", i, d, e)
+		}
+	}
+
+	// test that jitter stays within its bounds
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := policy.delay(0); d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("The jittered delay is out of bounds! %s", d)
+		}
+	}
+
+	// test that a huge number of retries does not overflow the delay
+	if d := (RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}).delay(100); d != time.Minute {
+		t.Fatalf("The delay overflowed! %s", d)
+	}
+}
+
+// returns a network whose requests to other time out after minRTO
+func newRetryTestNetwork(other Contact) (*Network, *MockMessenger) {
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var rt = NewRoutingTable(me)
+	var messenger = &MockMessenger{Rt: rt}
+	var n = &Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         messenger,
+		RetryPolicies: map[string]RetryPolicy{
+			"PING": {Retries: 2, BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond},
+		},
+	}
+	rt.RecordRTT(&other, time.Millisecond)
+	return n, messenger
+}
+
+func TestRetryUnansweredRequest(t *testing.T) {
+	var other = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "127.0.0.1:1235")
+	n, messenger := newRetryTestNetwork(other)
+
+	res, err := n.PingContext(context.Background(), &other)
+	if res.MsgType != "TIMEOUT" || err != context.DeadlineExceeded {
+		t.Fatalf("An unanswered ping should time out after all retries! %v", err)
+	}
+
+	// test that the ping was sent three times with the same RPCID
+	if len(messenger.Messages) != 3 {
+		t.Fatalf("The ping should have been sent 3 times, not %d!", len(messenger.Messages))
+	}
+	for _, m := range messenger.Messages {
+		if m.RPCID != res.RPCID {
+			t.Fatalf("A retry was sent with another RPCID!")
+		}
+	}
+
+	// test that message types without a policy are only sent once
+	messenger.Messages = nil
+	n.FindContactContext(context.Background(), *NewRandomKademliaID(), &other)
+	if len(messenger.Messages) != 1 {
+		t.Fatalf("A message without a retry policy was sent %d times!", len(messenger.Messages))
+	}
+}
+
+func TestRetryLateResponse(t *testing.T) {
+	var other = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "127.0.0.1:1235")
+	n, messenger := newRetryTestNetwork(other)
+
+	// answer the first attempt after it has already timed out
+	go func() {
+		time.Sleep(minRTO + minRTO/2)
+		m, _ := messenger.GetLatestMessage()
+		n.handleResponse(Message{MsgType: "PONG", RPCID: m.RPCID, Sender: other})
+	}()
+
+	res, err := n.PingContext(context.Background(), &other)
+	if err != nil || res.MsgType != "PONG" {
+		t.Fatalf("The late response should have been accepted! %v", err)
+	}
+
+	// a response that may belong to a retry is not used as a round trip time
+	if stats, _ := n.Rt.RTT(&other); stats.Samples != 1 {
+		t.Fatalf("The response to a retry was used as a round trip time sample!")
+	}
+}
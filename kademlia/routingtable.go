@@ -1,115 +1,272 @@
 package kademlia
 
 import (
+	"log"
 	"sync"
+	"time"
 )
 
-const bucketSize = 4
+// ContactTable keeps the contacts of a node. RoutingTable has a bucket for every length of the
+// prefix a contact has in common with me, TreeRoutingTable splits buckets as in the Kademlia paper.
+// Config.TreeTable picks the one a node uses, so the lookups of both designs can be compared.
+type ContactTable interface {
+	Me() Contact
+	SetAddress(address string)
+	K() int
+	Puzzle() Puzzle
+	SetPuzzle(puzzle Puzzle)
+
+	AddContact(contact Contact, ping func(*Contact, chan Message))
+	AddSender(contact Contact, ping func(*Contact, chan Message))
+	ContactFailed(contact *Contact)
+	FindClosestContacts(target *KademliaID, count int) []Contact
+	FindClosestContactsExclude(target *KademliaID, count int, exclude ...KademliaID) []Contact
+	Buckets() []BucketInfo
+
+	markLookup(target *KademliaID)
+	StaleBuckets(interval time.Duration) []int
+	RandomIDInBucket(index int) *KademliaID
+
+	Timeout(contact *Contact) time.Duration
+	RTT(contact *Contact) (RTTStats, bool)
+	RecordRTT(contact *Contact, rtt time.Duration)
+	RecordTimeout(contact *Contact)
+}
+
+// the parts of a routing table that do not depend on how the contacts are kept
+type tableBase struct {
+	me      Contact
+	meLock  sync.RWMutex         // protects the address of me and the puzzle, the ID never changes
+	puzzle  Puzzle               // contacts that do not solve it are never added
+	rtts    map[string]*RTTStats // map of address : round trip times, dropped when the contact is removed
+	rttLock sync.Mutex
+	k       int           // size of every bucket
+	timeout time.Duration // timeout of contacts without measured round trips, the upper bound of every timeout
+}
 
 // RoutingTable definition
 // keeps a refrence contact of me and an array of buckets
 type RoutingTable struct {
-	me      Contact
-	buckets [IDLength * 8]*bucket
-	lock    sync.Mutex
+	tableBase
+	buckets   [IDLength * 8]*bucket
+	lock      sync.Mutex     // protects the buckets
+	evictions sync.WaitGroup // pings of the oldest contacts of full buckets
 }
 
-// NewRoutingTable returns a new instance of a RoutingTable
+// NewRoutingTable returns a new instance of a RoutingTable with the default configuration
 func NewRoutingTable(me Contact) *RoutingTable {
-	routingTable := &RoutingTable{}
+	return NewRoutingTableWithConfig(me, DefaultConfig())
+}
+
+// NewRoutingTableWithConfig returns a new instance of a RoutingTable that uses the K and Timeout of config
+func NewRoutingTableWithConfig(me Contact, config Config) *RoutingTable {
+	routingTable := &RoutingTable{tableBase: newTableBase(me, config)}
 	for i := 0; i < IDLength*8; i++ {
-		routingTable.buckets[i] = newBucket()
+		routingTable.buckets[i] = newBucket(routingTable.k)
 	}
-	routingTable.me = me
 	return routingTable
 }
 
-// AddContact add a new contact to the correct Bucket
+// the base of a routing table of me that uses the K and Timeout of config
+func newTableBase(me Contact, config Config) tableBase {
+	config = config.withDefaults()
+	return tableBase{me: me, k: config.K, timeout: config.Timeout}
+}
+
+// K returns the size of the buckets, which is also the number of contacts a lookup returns
+func (table *tableBase) K() int {
+	return table.k
+}
+
+// Me returns the contact of this node
+func (table *tableBase) Me() Contact {
+	table.meLock.RLock()
+	defer table.meLock.RUnlock()
+	return table.me
+}
+
+// SetAddress changes the address this node advertises for the address family of address
+func (table *tableBase) SetAddress(address string) {
+	table.meLock.Lock()
+	defer table.meLock.Unlock()
+	table.me.setAddress(address)
+}
+
+// AddContact adds contact to the correct Bucket without waiting for the network. If the bucket is
+// full contact waits in the replacement cache, and the oldest contact of the bucket is pinged in the
+// background. The oldest contact is replaced by the freshest candidate if it does not respond.
+// A known contact keeps its address, as the contacts other nodes tell about could have any address.
 func (routingTable *RoutingTable) AddContact(contact Contact, ping func(*Contact, chan Message)) {
-	routingTable.lock.Lock()
+	routingTable.addContact(contact, ping, false)
+}
+
+// AddSender adds contact like AddContact, but a known contact takes the address of contact. Only the
+// sender of a message received directly from an address that answered our packets is trusted with that.
+func (routingTable *RoutingTable) AddSender(contact Contact, ping func(*Contact, chan Message)) {
+	routingTable.addContact(contact, ping, true)
+}
+
+// add contact, a known contact takes its address if moved
+func (routingTable *RoutingTable) addContact(contact Contact, ping func(*Contact, chan Message), moved bool) {
 	if *contact.ID == *routingTable.me.ID {
-		routingTable.lock.Unlock()
 		return
-	} else {
-		bucketIndex := routingTable.getBucketIndex(contact.ID)
-		bucket := routingTable.buckets[bucketIndex]
-		bucket.AddContact(contact, ping)
-		routingTable.lock.Unlock()
+	} else if err := routingTable.Puzzle().Check(contact); err != nil {
+		log.Println("Not adding contact", contact.Address, err)
+		return
+	}
+
+	routingTable.lock.Lock()
+	defer routingTable.lock.Unlock()
+	bucket := routingTable.buckets[routingTable.getBucketIndex(contact.ID)]
+	if oldest, full := bucket.insert(contact, moved); full && !bucket.checking { // one ping per bucket at a time
+		bucket.checking = true
+		routingTable.evictions.Add(1)
+		go routingTable.checkEviction(bucket, oldest, ping)
 	}
 }
 
-// FindClosestContacts finds the count closest Contacts to the target in the RoutingTable
-func (routingTable *RoutingTable) FindClosestContacts(target *KademliaID, count int) []Contact {
-	var candidates ContactCandidates
-	bucketIndex := routingTable.getBucketIndex(target)
-	bucket := routingTable.buckets[bucketIndex]
+// ping the oldest contact of bucket without holding the lock, then apply the response
+func (routingTable *RoutingTable) checkEviction(bucket *bucket, oldest Contact, ping func(*Contact, chan Message)) {
+	defer routingTable.evictions.Done()
 
-	candidates.Append(bucket.GetContactAndCalcDistance(target))
+	responseCh := make(chan Message)
+	go ping(&oldest, responseCh)
+	response := <-responseCh
 
-	for i := 1; (bucketIndex-i >= 0 || bucketIndex+i < IDLength*8) && candidates.Len() < count; i++ {
-		if bucketIndex-i >= 0 {
-			bucket = routingTable.buckets[bucketIndex-i]
-			candidates.Append(bucket.GetContactAndCalcDistance(target))
-		}
-		if bucketIndex+i < IDLength*8 {
-			bucket = routingTable.buckets[bucketIndex+i]
-			candidates.Append(bucket.GetContactAndCalcDistance(target))
-		}
+	routingTable.lock.Lock()
+	defer routingTable.lock.Unlock()
+	bucket.checking = false
+	if bucket.checked(oldest, response) {
+		routingTable.forgetRTT(&oldest)
 	}
+}
 
-	candidates.Sort()
-
-	if count > candidates.Len() {
-		count = candidates.Len()
+// ContactFailed replaces contact by the freshest candidate of the replacement cache of its bucket
+// after it failed to respond. Without candidates the contact stays in the bucket.
+func (routingTable *RoutingTable) ContactFailed(contact *Contact) {
+	if contact.ID == nil {
+		return
 	}
+	routingTable.lock.Lock()
+	defer routingTable.lock.Unlock()
 
-	return candidates.GetContacts(count)
+	if candidate, ok := routingTable.buckets[routingTable.getBucketIndex(contact.ID)].replaceFailed(contact.ID); ok {
+		log.Println("Replaced failed contact", contact.Address, "with", candidate.Address)
+		routingTable.forgetRTT(contact)
+	}
 }
 
-// FindClosestContacts finds the count closest Contacts to the target in the RoutingTable
-func (routingTable *RoutingTable) FindClosestContactsExclude(target *KademliaID, count int, exclude KademliaID) []Contact {
-	var candidates ContactCandidates
-	bucketIndex := routingTable.getBucketIndex(target)
-	bucket := routingTable.buckets[bucketIndex]
+// BucketInfo is a snapshot of a bucket of the routing table, see RoutingTable.Buckets
+type BucketInfo struct {
+	Index        int       // the number of leading bits the contacts have in common with me
+	Contacts     []Contact // the most recently seen first
+	Replacements []Contact // candidates for when a contact fails, the freshest first
+	LastLookup   time.Time // when a lookup in the range of the bucket was last started
+}
 
-	candidates.Append(bucket.GetContactAndCalcDistance(target))
+// Buckets returns a snapshot of every bucket of the routing table, ordered by index
+func (routingTable *RoutingTable) Buckets() []BucketInfo {
+	routingTable.lock.Lock()
+	defer routingTable.lock.Unlock()
 
-	for i := 1; (bucketIndex-i >= 0 || bucketIndex+i < IDLength*8) && candidates.Len() < count; i++ {
-		if bucketIndex-i >= 0 {
-			bucket = routingTable.buckets[bucketIndex-i]
-			candidates.Append(bucket.GetContactAndCalcDistance(target))
-		}
-		if bucketIndex+i < IDLength*8 {
-			bucket = routingTable.buckets[bucketIndex+i]
-			candidates.Append(bucket.GetContactAndCalcDistance(target))
+	buckets := make([]BucketInfo, len(routingTable.buckets))
+	for i, bucket := range routingTable.buckets {
+		buckets[i] = BucketInfo{
+			Index:        i,
+			Contacts:     listContacts(bucket.list),
+			Replacements: listContacts(bucket.replacements),
+			LastLookup:   bucket.lastLookup,
 		}
 	}
+	return buckets
+}
 
-	candidates.Sort()
+// FindClosestContacts finds the count closest Contacts to the target in the RoutingTable
+func (routingTable *RoutingTable) FindClosestContacts(target *KademliaID, count int) []Contact {
+	return routingTable.FindClosestContactsExclude(target, count)
+}
 
-	if count > candidates.Len() {
-		count = candidates.Len()
+// FindClosestContactsExclude finds the count closest Contacts to the target in the RoutingTable,
+// leaving out the contacts with an ID in exclude.
+//
+// The buckets are visited in the order of their distance to target, so only the buckets that hold
+// the result are sorted. The contacts in the bucket of target are the closest, they are the only ones
+// that differ from me in the same leading bit as target. Next are the contacts of all buckets with a
+// longer common prefix with me, which all differ from target in that bit. Last are the buckets with a
+// shorter common prefix, each one farther away than the one before.
+func (routingTable *RoutingTable) FindClosestContactsExclude(target *KademliaID, count int, exclude ...KademliaID) []Contact {
+	routingTable.lock.Lock()
+	defer routingTable.lock.Unlock()
+
+	excluded := make(map[KademliaID]bool, len(exclude))
+	for _, id := range exclude {
+		excluded[id] = true
 	}
 
-	for i, e := range candidates.contacts {
-		if *e.ID == exclude {
-			candidates.contacts = append(candidates.contacts[:i], candidates.contacts[i+1:]...)
-		}
+	index := routingTable.getBucketIndex(target)
+	closest := routingTable.closestInBuckets(target, excluded, index, index+1)
+	if len(closest) < count {
+		closest = append(closest, routingTable.closestInBuckets(target, excluded, index+1, IDLength*8)...)
 	}
+	for i := index - 1; i >= 0 && len(closest) < count; i-- {
+		closest = append(closest, routingTable.closestInBuckets(target, excluded, i, i+1)...)
+	}
+	return closest[:max(min(count, len(closest)), 0)]
+}
 
-	return candidates.GetContacts(count)
+// the contacts of the buckets from index start up to end that are not excluded, sorted by their distance to target
+func (routingTable *RoutingTable) closestInBuckets(target *KademliaID, excluded map[KademliaID]bool, start int, end int) []Contact {
+	var candidates ContactCandidates
+	for _, bucket := range routingTable.buckets[start:end] {
+		for e := bucket.list.Front(); e != nil; e = e.Next() {
+			contact := e.Value.(Contact)
+			if !excluded[*contact.ID] {
+				contact.CalcDistance(target)
+				candidates.contacts = append(candidates.contacts, contact)
+			}
+		}
+	}
+	candidates.Sort()
+	return candidates.contacts
 }
 
-// getBucketIndex get the correct Bucket index for the KademliaID
+// getBucketIndex get the correct Bucket index for the KademliaID, which is the number of
+// leading bits it has in common with me. The last bucket also holds the ID of me.
 func (routingTable *RoutingTable) getBucketIndex(id *KademliaID) int {
-	distance := id.CalcDistance(routingTable.me.ID)
-	for i := 0; i < IDLength; i++ {
-		for j := 0; j < 8; j++ {
-			if (distance[i]>>uint8(7-j))&0x1 != 0 {
-				return i*8 + j
-			}
+	return min(id.CommonPrefixLength(routingTable.me.ID), IDLength*8-1)
+}
+
+// markLookup remembers that a lookup for target was started, so the bucket of its range is not stale
+func (routingTable *RoutingTable) markLookup(target *KademliaID) {
+	routingTable.lock.Lock()
+	defer routingTable.lock.Unlock()
+	routingTable.buckets[routingTable.getBucketIndex(target)].lastLookup = time.Now()
+}
+
+// StaleBuckets returns the indexes of the buckets that had no lookup in their range for interval.
+// Buckets closer to me than every contact are left out, as a lookup in their ranges finds the
+// same contacts as a lookup in the range of the closest bucket that has contacts.
+func (routingTable *RoutingTable) StaleBuckets(interval time.Duration) []int {
+	routingTable.lock.Lock()
+	defer routingTable.lock.Unlock()
+
+	closest := -1
+	for i, bucket := range routingTable.buckets {
+		if bucket.Len() > 0 {
+			closest = i
 		}
 	}
 
-	return IDLength*8 - 1
+	var stale []int
+	for i := 0; i <= closest; i++ {
+		if time.Since(routingTable.buckets[i].lastLookup) >= interval {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// RandomIDInBucket returns a random ID in the range of the bucket with index
+func (routingTable *RoutingTable) RandomIDInBucket(index int) *KademliaID {
+	return NewRandomKademliaIDWithPrefix(routingTable.me.ID, index)
 }
@@ -1,7 +1,11 @@
 package kademlia
 
 import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type Detail struct {
@@ -46,8 +50,8 @@ func TestRoutingTable(t *testing.T) {
 	// Add dummy contacts that should not be added to table
 	//contacts = append(contacts, contacts...)
 
-	// Test routing table creation
-	table := NewRoutingTable(contacts[0])
+	// Test routing table creation, all contacts share a bucket so it has to hold all of them
+	table := NewRoutingTableWithConfig(contacts[0], Config{K: len(contacts)})
 
 	// Test routing table population
 	for _, contact := range contacts {
@@ -67,3 +71,268 @@ func TestRoutingTable(t *testing.T) {
 		t.Error("[FAIL] Incorrect closest contacts found")
 	}
 }
+
+func TestStaleBuckets(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "localhost:8000")
+	var table = NewRoutingTable(me)
+	/*-----------------------------------------------------------------------------------------------*/
+
+	// contacts in bucket 0 and 3
+	table.AddContact(NewContact(NewKademliaID("1111111100000000000000000000000000000000"), "localhost:8001"), pingTest)
+	table.AddContact(NewContact(NewKademliaID("EFFFFFFF00000000000000000000000000000000"), "localhost:8002"), pingTest)
+
+	if stale := table.StaleBuckets(time.Minute); len(stale) != 0 {
+		t.Fatalf("New buckets are stale! %v", stale)
+	}
+
+	// test that only the buckets up to the closest contact are stale
+	for _, bucket := range table.buckets {
+		bucket.lastLookup = time.Now().Add(-time.Hour)
+	}
+	if stale := table.StaleBuckets(time.Minute); len(stale) != 4 || stale[0] != 0 || stale[3] != 3 {
+		t.Fatalf("The wrong buckets are stale! %v", stale)
+	}
+
+	// test that a lookup in the range of a bucket makes it fresh
+	for _, index := range []int{1, 3} {
+		id := table.RandomIDInBucket(index)
+		if table.getBucketIndex(id) != index {
+			t.Fatalf("The random ID %s is not in bucket %d!", id, index)
+		}
+		table.markLookup(id)
+	}
+	if stale := table.StaleBuckets(time.Minute); len(stale) != 2 || stale[0] != 0 || stale[1] != 2 {
+		t.Fatalf("The buckets that had a lookup are still stale! %v", stale)
+	}
+}
+
+func TestContactFailed(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "localhost:8000")
+	var table = NewRoutingTableWithConfig(me, Config{K: 1})
+	var failed = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "localhost:8001")
+	var candidate = NewContact(NewKademliaID("2FFFFFFF00000000000000000000000000000000"), "localhost:8002")
+	/*-----------------------------------------------------------------------------------------------*/
+
+	table.AddContact(failed, pingTest)
+	table.AddContact(candidate, pingTest)
+
+	// test that the candidate is visible in the snapshot of its bucket
+	bucket := table.Buckets()[0]
+	if len(bucket.Contacts) != 1 || len(bucket.Replacements) != 1 || *bucket.Replacements[0].ID != *candidate.ID {
+		t.Fatalf("The replacement cache is not in the snapshot! %+v", bucket)
+	}
+
+	table.ContactFailed(&Contact{Address: "localhost:8001"}) // a contact without ID is not in the table
+	table.ContactFailed(&failed)
+	if bucket := table.Buckets()[0]; len(bucket.Contacts) != 1 || *bucket.Contacts[0].ID != *candidate.ID || len(bucket.Replacements) != 0 {
+		t.Fatalf("The failed contact was not replaced by the candidate! %+v", bucket)
+	}
+}
+
+func TestAddContactDoesNotBlock(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "localhost:8000")
+	var table = NewRoutingTableWithConfig(me, Config{K: 2})
+	var release = make(chan struct{})
+	var pings atomic.Int32
+	var slowPing = func(_ *Contact, out chan Message) { // the oldest contacts never respond
+		pings.Add(1)
+		<-release
+		out <- Message{MsgType: "TIMEOUT"}
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	// test that contacts are added and looked up concurrently while the pings are waiting
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				table.AddContact(NewContact(NewRandomKademliaID(), "localhost:8001"), slowPing)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				table.FindClosestContacts(NewRandomKademliaID(), 4)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Adding contacts waited for the pings!")
+	}
+
+	// test that a full bucket pings one contact at a time, and promotes a candidate when it fails
+	before := table.Buckets()[0]
+	if pings.Load() > IDLength*8 || len(before.Replacements) == 0 {
+		t.Fatalf("The full buckets did not wait for their checks! %d pings", pings.Load())
+	}
+	close(release)
+	table.evictions.Wait()
+	after := table.Buckets()[0]
+	if *after.Contacts[0].ID != *before.Replacements[0].ID || len(after.Replacements) != len(before.Replacements)-1 {
+		t.Fatalf("The freshest candidate was not promoted! %v %v", before, after)
+	}
+}
+
+// a routing table of me with the given contacts, and the contacts it kept
+func newFilledRoutingTable(me Contact, k int, contacts []Contact) (*RoutingTable, []Contact) {
+	table := NewRoutingTableWithConfig(me, Config{K: k})
+	for _, contact := range contacts {
+		table.AddContact(contact, pingTest)
+	}
+	table.evictions.Wait()
+
+	var kept []Contact
+	for _, bucket := range table.Buckets() {
+		kept = append(kept, bucket.Contacts...)
+	}
+	return table, kept
+}
+
+// an ID drawn from random, so a failing trial can be repeated with the same seed
+func seededKademliaID(random *rand.Rand) *KademliaID {
+	var id KademliaID
+	random.Read(id[:])
+	return &id
+}
+
+// an ID drawn from random that has exactly the first length bits in common with prefix, see NewRandomKademliaIDWithPrefix
+func seededKademliaIDWithPrefix(random *rand.Rand, prefix *KademliaID, length int) *KademliaID {
+	id := seededKademliaID(random)
+	for bit := 0; bit <= length && bit < IDLength*8; bit++ {
+		i, mask := bit/8, byte(0x80)>>(bit%8)
+		value := prefix[i] & mask
+		if bit == length { // the first bit that differs
+			value ^= mask
+		}
+		id[i] = id[i]&^mask | value
+	}
+	return id
+}
+
+func TestFindClosestContactsProperty(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	for trial := 0; trial < 100; trial++ {
+		me := NewContact(seededKademliaID(random), "localhost:8000")
+		k := []int{1, 2, 4, 20}[random.Intn(4)]
+
+		// random contacts are mostly in the first buckets, so some share a longer prefix with me
+		var contacts []Contact
+		for i := random.Intn(300); i > 0; i-- {
+			id := seededKademliaID(random)
+			if random.Intn(2) == 0 {
+				id = seededKademliaIDWithPrefix(random, me.ID, random.Intn(IDLength*8))
+			}
+			contacts = append(contacts, NewContact(id, "localhost:8001"))
+		}
+		table, kept := newFilledRoutingTable(me, k, contacts)
+
+		for i := 0; i < 20; i++ {
+			targets := []*KademliaID{seededKademliaID(random), me.ID, seededKademliaIDWithPrefix(random, me.ID, random.Intn(IDLength*8+1))}
+			if len(kept) > 0 {
+				targets = append(targets, kept[random.Intn(len(kept))].ID)
+			}
+			count := []int{0, 1, k, random.Intn(len(kept) + 5)}[random.Intn(4)]
+
+			// exclude a random part of the contacts, and an ID that is not in the table
+			exclude := []KademliaID{*seededKademliaID(random)}
+			var remaining []Contact
+			for _, contact := range kept {
+				if random.Intn(4) == 0 {
+					exclude = append(exclude, *contact.ID)
+				} else {
+					remaining = append(remaining, contact)
+				}
+			}
+
+			// test that the result is exactly the result of sorting every contact
+			for _, target := range targets {
+				for _, test := range []struct {
+					found    []Contact
+					expected []Contact
+				}{
+					{table.FindClosestContacts(target, count), bruteForceClosest(kept, target, count)},
+					{table.FindClosestContactsExclude(target, count, exclude...), bruteForceClosest(remaining, target, count)},
+				} {
+					if len(test.found) != len(test.expected) {
+						t.Fatalf("Found %d contacts instead of %d for %s!", len(test.found), len(test.expected), target)
+					}
+					for j := range test.found {
+						if *test.found[j].ID != *test.expected[j].ID {
+							t.Fatalf("Contact %d of the %d closest to %s is %s instead of %s!", j, count, target, test.found[j].ID, test.expected[j].ID)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// a routing table that holds thousands of contacts, its buckets are large enough to keep most of them
+func benchmarkRoutingTable(b *testing.B) *RoutingTable {
+	me := NewContact(NewRandomKademliaID(), "localhost:8000")
+	var contacts []Contact
+	for i := 0; i < 5000; i++ {
+		contacts = append(contacts, NewContact(NewRandomKademliaID(), "localhost:8001"))
+	}
+	table, kept := newFilledRoutingTable(me, 1000, contacts)
+	if len(kept) < 3000 {
+		b.Fatalf("The routing table only kept %d contacts!", len(kept))
+	}
+	return table
+}
+
+func BenchmarkFindClosestContacts(b *testing.B) {
+	table := benchmarkRoutingTable(b)
+	targets := make([]*KademliaID, 100)
+	for i := range targets {
+		targets[i] = NewRandomKademliaID()
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		table.FindClosestContacts(targets[i%len(targets)], 20)
+	}
+}
+
+func BenchmarkFindClosestContactsNearMe(b *testing.B) {
+	table := benchmarkRoutingTable(b)
+	targets := make([]*KademliaID, 100)
+	for i := range targets { // the bucket of these targets holds the fewest contacts
+		targets[i] = NewRandomKademliaIDWithPrefix(table.Me().ID, 12)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		table.FindClosestContacts(targets[i%len(targets)], 20)
+	}
+}
+
+func BenchmarkFindClosestContactsExclude(b *testing.B) {
+	table := benchmarkRoutingTable(b)
+	targets := make([]*KademliaID, 100)
+	for i := range targets {
+		targets[i] = NewRandomKademliaID()
+	}
+	exclude := table.FindClosestContacts(targets[0], 20)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		table.FindClosestContactsExclude(targets[i%len(targets)], 20, *exclude[i%len(exclude)].ID)
+	}
+}
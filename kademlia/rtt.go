@@ -0,0 +1,107 @@
+package kademlia
+
+import (
+	"time"
+)
+
+// lower bound of the per contact timeout, the upper bound is the timeout used before anything
+// is known about a contact, see Config.Timeout
+const minRTO = 200 * time.Millisecond
+
+// RTTStats holds the measured round trip times to a contact and the timeout computed from them,
+// in the same way as the retransmission timeout of TCP (RFC 6298)
+type RTTStats struct {
+	SRTT    time.Duration // smoothed round trip time
+	RTTVar  time.Duration // variation of the round trip time
+	RTO     time.Duration // how long to wait for a response from the contact
+	Samples int           // number of measured round trips
+	maxRTO  time.Duration // upper bound of RTO
+}
+
+// newRTTStats returns the stats of a contact that has never been measured, maxRTO is its timeout
+func newRTTStats(maxRTO time.Duration) *RTTStats {
+	return &RTTStats{RTO: maxRTO, maxRTO: maxRTO}
+}
+
+// add a measured round trip time and update the timeout
+func (stats *RTTStats) addSample(rtt time.Duration) {
+	if stats.Samples == 0 {
+		stats.SRTT = rtt
+		stats.RTTVar = rtt / 2
+	} else {
+		diff := stats.SRTT - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		stats.RTTVar = (3*stats.RTTVar + diff) / 4
+		stats.SRTT = (7*stats.SRTT + rtt) / 8
+	}
+	stats.Samples++
+
+	stats.RTO = stats.SRTT + max(time.Millisecond, 4*stats.RTTVar)
+	stats.RTO = min(max(stats.RTO, minRTO), stats.maxRTO)
+}
+
+// double the timeout after the contact failed to respond in time
+func (stats *RTTStats) backoff() {
+	stats.RTO = min(2*stats.RTO, stats.maxRTO)
+}
+
+// RecordRTT adds a measured round trip time to contact
+func (table *tableBase) RecordRTT(contact *Contact, rtt time.Duration) {
+	table.rttLock.Lock()
+	defer table.rttLock.Unlock()
+	table.rttStats(contact).addSample(rtt)
+}
+
+// RecordTimeout backs off the timeout of contact after it did not respond in time
+func (table *tableBase) RecordTimeout(contact *Contact) {
+	table.rttLock.Lock()
+	defer table.rttLock.Unlock()
+	table.rttStats(contact).backoff()
+}
+
+// Timeout returns how long to wait for a response from contact
+func (table *tableBase) Timeout(contact *Contact) time.Duration {
+	table.rttLock.Lock()
+	defer table.rttLock.Unlock()
+
+	if stats, ok := table.rtts[contact.Address]; ok {
+		return stats.RTO
+	}
+	return table.timeout
+}
+
+// RTT returns the round trip time statistics of contact, false if nothing has been recorded
+func (table *tableBase) RTT(contact *Contact) (RTTStats, bool) {
+	table.rttLock.Lock()
+	defer table.rttLock.Unlock()
+
+	stats, ok := table.rtts[contact.Address]
+	if !ok {
+		return RTTStats{}, false
+	}
+	return *stats, true
+}
+
+// forget the round trip times of contact after it was removed from the table, so the map only
+// grows with the contacts that are kept
+func (table *tableBase) forgetRTT(contact *Contact) {
+	table.rttLock.Lock()
+	defer table.rttLock.Unlock()
+	delete(table.rtts, contact.Address)
+}
+
+// get the stats of contact, creating them if needed. rttLock has to be held
+func (table *tableBase) rttStats(contact *Contact) *RTTStats {
+	if table.rtts == nil {
+		table.rtts = make(map[string]*RTTStats)
+	}
+
+	stats, ok := table.rtts[contact.Address]
+	if !ok {
+		stats = newRTTStats(table.timeout)
+		table.rtts[contact.Address] = stats
+	}
+	return stats
+}
@@ -0,0 +1,133 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRTTStats(t *testing.T) {
+	stats := newRTTStats(DefaultTimeout)
+
+	// test that nothing measured means the full timeout
+	if stats.RTO != DefaultTimeout {
+		t.Fatalf("An unmeasured contact should use the default timeout! %s", stats.RTO)
+	}
+
+	// test the first sample, RTTVar is half of the sample
+	stats.addSample(400 * time.Millisecond)
+	if stats.SRTT != 400*time.Millisecond || stats.RTTVar != 200*time.Millisecond || stats.RTO != 1200*time.Millisecond {
+		t.Fatalf("The first sample was not recorded correctly! %+v", *stats)
+	}
+
+	// test a second sample, SRTT = 7/8 SRTT + 1/8 R and RTTVar = 3/4 RTTVar + 1/4 |SRTT - R|
+	stats.addSample(800 * time.Millisecond)
+	if stats.SRTT != 450*time.Millisecond || stats.RTTVar != 250*time.Millisecond || stats.RTO != 1450*time.Millisecond {
+		t.Fatalf("The second sample was not recorded correctly! %+v", *stats)
+	}
+
+	// test that the timeout is doubled but never more than the maximum
+	stats.backoff()
+	if stats.RTO != 2900*time.Millisecond {
+		t.Fatalf("The timeout was not doubled! %s", stats.RTO)
+	}
+	stats.backoff()
+	if stats.RTO != DefaultTimeout {
+		t.Fatalf("The timeout was not capped! %s", stats.RTO)
+	}
+
+	// test that fast contacts never get a timeout below the minimum
+	fast := newRTTStats(DefaultTimeout)
+	for i := 0; i < 10; i++ {
+		fast.addSample(time.Millisecond)
+	}
+	if fast.RTO != minRTO {
+		t.Fatalf("The timeout is below the minimum! %s", fast.RTO)
+	}
+}
+
+func TestRoutingTableRTT(t *testing.T) {
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var other = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "127.0.0.1:1235")
+	var rt = NewRoutingTable(me)
+
+	if _, ok := rt.RTT(&other); ok || rt.Timeout(&other) != DefaultTimeout {
+		t.Fatalf("An unmeasured contact should have no RTT and the default timeout!")
+	}
+
+	rt.RecordRTT(&other, 10*time.Millisecond)
+	stats, ok := rt.RTT(&other)
+	if !ok || stats.Samples != 1 || stats.SRTT != 10*time.Millisecond {
+		t.Fatalf("The RTT was not recorded! %+v", stats)
+	}
+	if rt.Timeout(&other) != minRTO {
+		t.Fatalf("The timeout was not based on the RTT! %s", rt.Timeout(&other))
+	}
+
+	rt.RecordTimeout(&other)
+	if rt.Timeout(&other) != 2*minRTO {
+		t.Fatalf("The timeout was not backed off! %s", rt.Timeout(&other))
+	}
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.Latency = time.Millisecond
+	a := sim.AddNode(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "a"))
+	b := sim.AddNode(NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "b"))
+
+	// measure the round trip time to b
+	for i := 0; i < 5; i++ {
+		if res, err := a.Network.PingContext(context.Background(), contactOf(b)); err != nil || res.MsgType != "PONG" {
+			t.Fatalf("The ping was not answered! %v", err)
+		}
+	}
+	if stats, ok := a.Rt.RTT(contactOf(b)); !ok || stats.Samples != 5 {
+		t.Fatalf("The round trip times were not recorded! %+v", stats)
+	}
+
+	// test that a node that stops responding times out as soon as its timeout has passed
+	a.Network.RetryPolicies = map[string]RetryPolicy{} // no retries
+	sim.Remove("b")
+	start := time.Now()
+	res := a.Network.SendAndAwaitResponse(contactOf(b), Message{MsgType: "PING", RPCID: *NewRandomKademliaID()})
+	if res.MsgType != "TIMEOUT" {
+		t.Fatalf("The removed node should not respond!")
+	}
+	if elapsed := time.Since(start); elapsed > 2*minRTO {
+		t.Fatalf("The request waited %s instead of the measured timeout!", elapsed)
+	}
+}
+
+func TestRTTForgottenWithContact(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var oldest = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "127.0.0.1:1235")
+	var newer = NewContact(NewKademliaID("1EFFFFFF00000000000000000000000000000000"), "127.0.0.1:1236")
+	var candidate = NewContact(NewKademliaID("1DFFFFFF00000000000000000000000000000000"), "127.0.0.1:1237")
+	var timeoutPing = func(_ *Contact, out chan Message) { out <- Message{MsgType: "TIMEOUT"} }
+	/*-----------------------------------------------------------------------------------------------*/
+
+	for _, table := range []ContactTable{NewRoutingTableWithConfig(me, Config{K: 1}), NewTreeRoutingTable(me, Config{K: 1})} {
+		// test that the round trip times of the oldest contact are dropped when it is evicted
+		table.AddContact(oldest, pingTest)
+		table.RecordRTT(&oldest, 10*time.Millisecond)
+		table.RecordRTT(&newer, 10*time.Millisecond)
+		table.AddContact(newer, timeoutPing)
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			if _, ok := table.RTT(&oldest); !ok {
+				break
+			} else if time.Now().After(deadline) {
+				t.Fatalf("The round trip times of the evicted contact were kept! %T", table)
+			}
+		}
+
+		// test that the round trip times of a failed contact are dropped when it is replaced
+		table.AddContact(candidate, pingTest) // waits in the replacement cache, newer answers pingTest
+		table.ContactFailed(&newer)
+		if _, ok := table.RTT(&newer); ok {
+			t.Fatalf("The round trip times of the replaced contact were kept! %T", table)
+		}
+	}
+}
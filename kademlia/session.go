@@ -0,0 +1,449 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// sessions beyond this are evicted, oldest first. A peer that used an evicted session gets no
+// response, forgets the session after the timeout and negotiates a new one.
+const maxSessions = 1024
+
+// number of counters below the highest received one that are still accepted, so messages that
+// were reordered by the network are not dropped
+const replayWindow = 64
+
+// size of the counter in front of the nonce of a sealed message
+const counterSize = 8
+
+// SecureMessenger encrypts every message before it is sent by Messenger. The first message to an
+// address starts a handshake, an X25519 key exchange in signed HANDSHAKE and HANDSHAKE_RESPONSE
+// messages, so both sides know who they share the session key with. Messages are then encoded,
+// encrypted with AES-GCM and sent as the body of a SEALED message. Sessions are cached by Network.
+type SecureMessenger struct {
+	Network   *Network
+	Messenger Messenger // sends the handshakes and the encrypted messages
+}
+
+// a negotiated session with a peer
+type session struct {
+	id   KademliaID  // sent with every encrypted message so the receiver can find the key
+	peer KademliaID  // ID of the node on the other side
+	aead cipher.AEAD // encrypts in both directions, every message has a random nonce
+
+	sent     atomic.Uint64 // counter of the last message sent in the session
+	lock     sync.Mutex
+	highest  uint64 // highest counter received from the peer
+	received uint64 // bit i is set if the counter highest-i was received
+}
+
+// the sessions of a network, by ID for received messages and by address for sent messages
+type sessionCache struct {
+	byID      map[KademliaID]*session
+	byAddress map[string]*session
+	order     []KademliaID                 // IDs in the order they were added, for eviction
+	pending   map[string]*pendingHandshake // handshakes in progress, by address
+	lock      sync.Mutex
+}
+
+// a handshake that every message to the same address waits for, instead of starting its own
+type pendingHandshake struct {
+	done    chan struct{} // closed when the handshake is over
+	session *session
+	err     error
+}
+
+var (
+	ErrNoIdentity     = errors.New("SESSION ERROR: encryption needs an identity to authenticate the handshake")
+	ErrHandshake      = errors.New("SESSION ERROR: handshake failed")
+	ErrNotEncrypted   = errors.New("SESSION ERROR: message is not encrypted")
+	ErrUnknownSession = errors.New("SESSION ERROR: unknown session")
+	ErrSessionPeer    = errors.New("SESSION ERROR: message was not sent by the peer of the session")
+	ErrReplayed       = errors.New("SESSION ERROR: message was already received")
+)
+
+// EnableEncryption makes the network encrypt every message it sends, and drop received plaintext
+// messages other than handshakes. Every node of the network has to enable it, a network without
+// encryption is easier to debug. Has to be called before the network is used.
+func (network *Network) EnableEncryption() error {
+	if network.Identity == nil {
+		return ErrNoIdentity
+	}
+	network.Messenger = &SecureMessenger{Network: network, Messenger: network.Messenger}
+	network.encrypted = true
+	return nil
+}
+
+// send message encrypted to contact, a session is negotiated first if there is none
+func (m *SecureMessenger) SendMessage(contact *Contact, msg Message) {
+	if msg.MsgType == "HANDSHAKE" || msg.MsgType == "HANDSHAKE_RESPONSE" { // sessions are negotiated in plaintext
+		m.Messenger.SendMessage(contact, msg)
+		return
+	}
+
+	s := m.Network.sessions().get(contact.Address)
+	if s == nil {
+		// a response sent by a worker can not wait longer than a request to the contact would
+		ctx, cancel := context.WithTimeout(context.Background(), m.Network.Rt.Timeout(contact))
+		defer cancel()
+
+		var err error
+		if s, err = m.Network.handshake(ctx, contact); err != nil {
+			log.Println("SESSION ERROR: could not negotiate a session with", contact.Address, err)
+			return
+		}
+	}
+
+	sealed, err := m.Network.seal(s, msg)
+	if err != nil {
+		log.Println("SESSION ERROR:", err)
+		return
+	}
+	m.Messenger.SendMessage(contact, sealed)
+}
+
+// Close closes the connections of the wrapped messenger
+func (m *SecureMessenger) Close() {
+	if c, ok := m.Messenger.(closer); ok {
+		c.Close()
+	}
+}
+
+// Handshake negotiates a session with contact. Both handshake messages are signed, so the
+// session key is only shared with the node that holds the key of the responding ID.
+func (network *Network) Handshake(ctx context.Context, contact *Contact) error {
+	_, err := network.handshake(ctx, contact)
+	return err
+}
+
+// negotiate a session with contact, or wait for the handshake with its address that is in progress.
+// The handshake itself is bounded by the timeout of the contact and stops when the network is
+// closed, ctx only limits how long the caller waits for it.
+func (network *Network) handshake(ctx context.Context, contact *Contact) (*session, error) {
+	if network.Identity == nil {
+		return nil, ErrNoIdentity
+	}
+
+	cache := network.sessions()
+	cache.lock.Lock()
+	p := cache.pending[contact.Address]
+	if p == nil {
+		p = &pendingHandshake{done: make(chan struct{})}
+		cache.pending[contact.Address] = p
+		go func(contact Contact) {
+			ctx, cancel := context.WithTimeout(context.Background(), network.Rt.Timeout(&contact))
+			p.session, p.err = network.negotiate(ctx, &contact)
+			cancel()
+
+			cache.lock.Lock()
+			delete(cache.pending, contact.Address)
+			cache.lock.Unlock()
+			close(p.done)
+		}(*contact)
+	}
+	cache.lock.Unlock()
+
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	if contact.ID != nil && p.session.peer != *contact.ID { // the handshake was started for another ID
+		return nil, ErrHandshake
+	}
+	return p.session, nil
+}
+
+// send our half of the key exchange to contact and derive the session from its response
+func (network *Network) negotiate(ctx context.Context, contact *Contact) (*session, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	m := Message{
+		MsgType: "HANDSHAKE",
+		RPCID:   *NewRandomKademliaID(),
+		Body:    string(ephemeral.PublicKey().Bytes()),
+	}
+	response, err := network.SendAndAwaitResponseContext(ctx, contact, m)
+	if err != nil {
+		return nil, err
+	}
+	if response.MsgType != "HANDSHAKE_RESPONSE" || len(response.Signature) == 0 ||
+		(contact.ID != nil && *response.Sender.ID != *contact.ID) {
+		return nil, ErrHandshake
+	}
+
+	s, err := newSession(ephemeral, []byte(response.Body), []byte(m.Body), []byte(response.Body), *response.Sender.ID)
+	if err != nil {
+		return nil, err
+	}
+	network.sessions().add(contact.Address, s)
+	return s, nil
+}
+
+// negotiate a session with contact before a message of msgType is sent to it, if the network is
+// encrypted and there is none yet
+func (network *Network) ensureSession(ctx context.Context, contact *Contact, msgType string) error {
+	if !network.encrypted || msgType == "HANDSHAKE" || msgType == "HANDSHAKE_RESPONSE" {
+		return nil
+	}
+	if network.sessions().get(contact.Address) != nil {
+		return nil
+	}
+	_, err := network.handshake(ctx, contact)
+	return err
+}
+
+// Answer a handshake with our half of the key exchange, the session is ready before the response is sent
+func (network *Network) SendHandshakeResponse(subject Message) {
+	if network.Identity == nil || len(subject.Signature) == 0 { // the initiator has to be authenticated as well
+		log.Println("SESSION ERROR: ignoring handshake from", subject.Sender.Address)
+		return
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		log.Println("SESSION ERROR:", err)
+		return
+	}
+
+	body := string(ephemeral.PublicKey().Bytes())
+	s, err := newSession(ephemeral, []byte(subject.Body), []byte(subject.Body), []byte(body), *subject.Sender.ID)
+	if err != nil {
+		log.Println("SESSION ERROR:", err)
+		return
+	}
+	network.sessions().add(subject.Sender.Address, s)
+
+	m := Message{
+		MsgType:  "HANDSHAKE_RESPONSE",
+		RPCID:    subject.RPCID,
+		Body:     body,
+		Observed: subject.Sender.Address,
+	}
+	network.reply(subject, m)
+}
+
+// derive the session from our ephemeral key and the ephemeral public key of the peer
+func newSession(private *ecdh.PrivateKey, peerPublic, initiator, responder []byte, peer KademliaID) (*session, error) {
+	remote, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	shared, err := private.ECDH(remote)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+
+	key := sha256.Sum256(bytes.Join([][]byte{[]byte("kademlia session key"), shared, initiator, responder}, []byte{0}))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	id := KademliaID(sha1.Sum(bytes.Join([][]byte{[]byte("kademlia session id"), initiator, responder}, []byte{0})))
+	return &session{id: id, peer: peer, aead: aead}, nil
+}
+
+// sign and encrypt msg into a SEALED message
+func (network *Network) seal(s *session, msg Message) (Message, error) {
+	msg.Sender = network.Rt.Me()
+	if err := network.Identity.Sign(&msg); err != nil {
+		return Message{}, err
+	}
+
+	data, err := codecOrDefault(network.Codec).Encode(msg)
+	if err != nil {
+		return Message{}, err
+	}
+
+	// the counter is authenticated with the message, so the receiver can drop replayed messages
+	counter := make([]byte, counterSize, counterSize+s.aead.NonceSize()+len(data)+s.aead.Overhead())
+	binary.BigEndian.PutUint64(counter, s.sent.Add(1))
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return Message{}, err
+	}
+
+	sealed := append(counter, nonce...)
+	return Message{
+		MsgType: "SEALED",
+		Key:     s.id,
+		Body:    string(s.aead.Seal(sealed, nonce, data, append(s.id[:], counter...))),
+	}, nil
+}
+
+// decrypt a received message. Plaintext messages are returned as they are, unless the network
+// is encrypted and they are not part of a handshake.
+func (network *Network) unseal(msg Message) (Message, error) {
+	switch msg.MsgType {
+	case "SEALED":
+	case "HANDSHAKE", "HANDSHAKE_RESPONSE":
+		return msg, nil
+	default:
+		if network.encrypted {
+			return Message{}, ErrNotEncrypted
+		}
+		return msg, nil
+	}
+
+	s := network.sessions().find(msg.Key)
+	if s == nil {
+		return Message{}, ErrUnknownSession
+	}
+
+	body := []byte(msg.Body)
+	if len(body) < counterSize+s.aead.NonceSize() {
+		return Message{}, ErrTruncated
+	}
+	counter, nonce := body[:counterSize], body[counterSize:counterSize+s.aead.NonceSize()]
+	data, err := s.aead.Open(nil, nonce, body[counterSize+len(nonce):], append(s.id[:], counter...))
+	if err != nil {
+		return Message{}, err
+	}
+
+	inner, err := network.readPacket(data)
+	if err != nil {
+		return Message{}, err
+	}
+	if inner.MsgType == "SEALED" || *inner.Sender.ID != s.peer {
+		return Message{}, ErrSessionPeer
+	}
+	if !s.receive(binary.BigEndian.Uint64(counter)) { // checked last, so only messages of the peer move the window
+		return Message{}, ErrReplayed
+	}
+	return inner, nil
+}
+
+// receive reports whether counter was not received in the session before. Counters further
+// than replayWindow below the highest one are not accepted, they can not be told apart from replays.
+func (s *session) receive(counter uint64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if counter > s.highest {
+		shift := counter - s.highest
+		if shift >= replayWindow {
+			s.received = 0
+		} else {
+			s.received <<= shift
+		}
+		s.received |= 1
+		s.highest = counter
+		return true
+	}
+
+	behind := s.highest - counter
+	if counter == 0 || behind >= replayWindow || s.received&(1<<behind) != 0 {
+		return false
+	}
+	s.received |= 1 << behind
+	return true
+}
+
+// forget the session with address, the next message negotiates a new one
+func (network *Network) forgetSession(address string) {
+	network.lock.Lock()
+	cache := network.sessionCache
+	network.lock.Unlock()
+
+	if cache != nil {
+		cache.remove(address)
+	}
+}
+
+// get the session cache, creating it if needed
+func (network *Network) sessions() *sessionCache {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	if network.sessionCache == nil {
+		network.sessionCache = &sessionCache{
+			byID:      make(map[KademliaID]*session),
+			byAddress: make(map[string]*session),
+			pending:   make(map[string]*pendingHandshake),
+		}
+	}
+	return network.sessionCache
+}
+
+// add s as the session with address, the oldest session is evicted if there are too many
+func (cache *sessionCache) add(address string, s *session) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	for len(cache.order) >= maxSessions {
+		oldest := cache.byID[cache.order[0]]
+		cache.order = cache.order[1:]
+		delete(cache.byID, oldest.id)
+		for address, other := range cache.byAddress {
+			if other == oldest {
+				delete(cache.byAddress, address)
+			}
+		}
+	}
+
+	cache.byID[s.id] = s
+	cache.byAddress[address] = s
+	cache.order = append(cache.order, s.id)
+}
+
+// get the session used for messages to address, nil if there is none
+func (cache *sessionCache) get(address string) *session {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.byAddress[address]
+}
+
+// get the session with id, nil if there is none
+func (cache *sessionCache) find(id KademliaID) *session {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.byID[id]
+}
+
+// remove the session with address
+func (cache *sessionCache) remove(address string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	s, ok := cache.byAddress[address]
+	if !ok {
+		return
+	}
+	delete(cache.byAddress, address)
+	delete(cache.byID, s.id)
+	for i, id := range cache.order {
+		if id == s.id {
+			cache.order = append(cache.order[:i], cache.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Sessions returns the number of negotiated sessions
+func (network *Network) Sessions() int {
+	cache := network.sessions()
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return len(cache.byID)
+}
@@ -0,0 +1,200 @@
+package kademlia
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a node with an identity that listens on a free port of 127.0.0.1
+func newSessionTestNode(t *testing.T, seed byte, encrypt bool) *Kademlia {
+	node := newTestKademliaWithIdentity(t, testIdentity(t, seed), "127.0.0.1:0")
+	if encrypt {
+		if err := node.Network.EnableEncryption(); err != nil {
+			t.Fatalf("Could not enable encryption: %s", err)
+		}
+	}
+
+	if err := node.Start(); err != nil {
+		t.Skipf("Could not listen: %s", err)
+	}
+	t.Cleanup(func() { node.Close() })
+
+	return node
+}
+
+// two nodes on the same host
+func newSessionTestPair(t *testing.T, encryptA bool, encryptB bool) (*Kademlia, *Kademlia) {
+	return newSessionTestNode(t, 1, encryptA), newSessionTestNode(t, 2, encryptB)
+}
+
+func TestEncryptedPing(t *testing.T) {
+	a, b := newSessionTestPair(t, true, true)
+
+	// test that the first message negotiates a session, and later messages reuse it
+	for i := 0; i < 2; i++ {
+		res, err := a.Network.PingContext(context.Background(), contactOf(b))
+		if err != nil || res.MsgType != "PONG" {
+			t.Fatalf("The encrypted ping was not answered! %v", err)
+		}
+	}
+	if a.Network.Sessions() != 1 || b.Network.Sessions() != 1 {
+		t.Fatalf("Exactly one session should have been negotiated! %d %d", a.Network.Sessions(), b.Network.Sessions())
+	}
+
+	// test that the receiver knows who sent the encrypted messages, it is added after the response is sent
+	time.Sleep(10 * time.Millisecond)
+	if closest := b.Rt.FindClosestContacts(a.Rt.Me().ID, 1); len(closest) != 1 || *closest[0].ID != *a.Rt.Me().ID {
+		t.Fatalf("The sender of the encrypted messages was not added to the routing table!")
+	}
+}
+
+func TestEncryptedRejectsPlaintext(t *testing.T) {
+	a, b := newSessionTestPair(t, false, true)
+
+	// a sends plaintext, which b drops
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := a.Network.PingContext(ctx, contactOf(b)); err == nil {
+		t.Fatalf("A plaintext ping was answered by an encrypted node!")
+	}
+	if b.Network.InvalidPackets("127.0.0.1") == 0 {
+		t.Fatalf("The plaintext ping was not counted as invalid!")
+	}
+
+	// a network without identity can not encrypt
+	if err := (&Network{}).EnableEncryption(); err != ErrNoIdentity {
+		t.Fatalf("Encryption was enabled without an identity!")
+	}
+}
+
+func TestSealUnseal(t *testing.T) {
+	a := newTestKademliaWithIdentity(t, testIdentity(t, 1), "127.0.0.1:1234").Network
+	b := newTestKademliaWithIdentity(t, testIdentity(t, 2), "127.0.0.2:1234").Network
+	b.encrypted = true
+
+	// negotiate a session by hand
+	ephemeralA, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	ephemeralB, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	pubA, pubB := ephemeralA.PublicKey().Bytes(), ephemeralB.PublicKey().Bytes()
+	sessionA, _ := newSession(ephemeralA, pubB, pubA, pubB, *b.Rt.Me().ID)
+	sessionB, _ := newSession(ephemeralB, pubA, pubA, pubB, *a.Rt.Me().ID)
+	if sessionA.id != sessionB.id {
+		t.Fatalf("Both sides should derive the same session ID!")
+	}
+	b.sessions().add("127.0.0.1:1234", sessionB)
+
+	// test that a sealed message can be opened by the peer
+	sealed, err := a.seal(sessionA, Message{MsgType: "STORE", Body: "secret", RPCID: *NewRandomKademliaID()})
+	if err != nil {
+		t.Fatalf("Could not seal message: %s", err)
+	}
+	if sealed.MsgType != "SEALED" || sealed.Body == "secret" {
+		t.Fatalf("The message was not encrypted!")
+	}
+	msg, err := b.unseal(sealed)
+	if err != nil || msg.MsgType != "STORE" || msg.Body != "secret" || *msg.Sender.ID != *a.Rt.Me().ID {
+		t.Fatalf("The sealed message was not opened correctly! %v", err)
+	}
+
+	// test that a message can not be replayed, but messages reordered by the network are accepted
+	if _, err := b.unseal(sealed); err != ErrReplayed {
+		t.Fatalf("A replayed message was accepted! %v", err)
+	}
+	second, _ := a.seal(sessionA, Message{MsgType: "PING"})
+	third, _ := a.seal(sessionA, Message{MsgType: "PING"})
+	if _, err := b.unseal(third); err != nil {
+		t.Fatalf("The newest message was rejected! %v", err)
+	}
+	if _, err := b.unseal(second); err != nil {
+		t.Fatalf("A reordered message was rejected! %v", err)
+	}
+	for i := 0; i < replayWindow; i++ {
+		a.seal(sessionA, Message{MsgType: "PING"})
+	}
+	late, _ := a.seal(sessionA, Message{MsgType: "PING"})
+	for i := 0; i < replayWindow; i++ {
+		newer, _ := a.seal(sessionA, Message{MsgType: "PING"})
+		b.unseal(newer)
+	}
+	if _, err := b.unseal(late); err != ErrReplayed {
+		t.Fatalf("A message older than the replay window was accepted! %v", err)
+	}
+
+	// test that a tampered message is rejected
+	tampered := sealed
+	body := []byte(tampered.Body)
+	body[len(body)-1] ^= 1
+	tampered.Body = string(body)
+	if _, err := b.unseal(tampered); err == nil {
+		t.Fatalf("A tampered message was accepted!")
+	}
+
+	// test that a message in an unknown session is rejected
+	unknown := sealed
+	unknown.Key = *NewRandomKademliaID()
+	if _, err := b.unseal(unknown); err != ErrUnknownSession {
+		t.Fatalf("A message in an unknown session was accepted! %v", err)
+	}
+
+	// test that only the peer of the session can use it
+	c := newTestKademliaWithIdentity(t, testIdentity(t, 3), "127.0.0.3:1234").Network
+	other, _ := c.seal(sessionA, Message{MsgType: "PING"})
+	if _, err := b.unseal(other); err != ErrSessionPeer {
+		t.Fatalf("A message from another node was accepted in the session! %v", err)
+	}
+
+	// test that an encrypted network drops plaintext but not handshakes
+	if _, err := b.unseal(Message{MsgType: "PING"}); err != ErrNotEncrypted {
+		t.Fatalf("A plaintext message was accepted by an encrypted network!")
+	}
+	if _, err := b.unseal(Message{MsgType: "HANDSHAKE"}); err != nil {
+		t.Fatalf("A handshake was rejected! %s", err)
+	}
+
+	// test that forgotten sessions are removed
+	b.forgetSession("127.0.0.1:1234")
+	if b.Sessions() != 0 {
+		t.Fatalf("The session was not forgotten!")
+	}
+}
+
+func TestConcurrentHandshakes(t *testing.T) {
+	a, b := newSessionTestPair(t, true, true)
+
+	// test that messages sent to the same address at the same time wait for one handshake
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, err := a.Network.PingContext(context.Background(), contactOf(b)); err != nil || res.MsgType != "PONG" {
+				t.Errorf("The encrypted ping was not answered! %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if a.Network.Sessions() != 1 || b.Network.Sessions() != 1 {
+		t.Fatalf("Concurrent messages negotiated more than one session! %d %d", a.Network.Sessions(), b.Network.Sessions())
+	}
+}
+
+func TestHandshakeCancelled(t *testing.T) {
+	a := newSessionTestNode(t, 1, true)
+	silent := NewContact(NewRandomKademliaID(), "127.0.0.1:1") // nothing answers the handshake
+	a.Network.RetryPolicies = map[string]RetryPolicy{}
+
+	// test that a caller that gives up does not wait for the handshake
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := a.Network.PingContext(ctx, &silent); err == nil {
+		t.Fatalf("A ping to a silent address was answered!")
+	}
+	if waited := time.Since(start); waited > a.Rt.Timeout(&silent)/2 {
+		t.Fatalf("The cancelled ping waited for the handshake! %s", waited)
+	}
+}
@@ -0,0 +1,150 @@
+package kademlia
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SimNetwork is an in-process network used for testing. Messages are handed directly to the
+// MessageHandler of the node registered at the contacts address instead of being sent over a
+// socket. Latency, packet loss, duplication and reordering can be configured to see how the
+// protocol behaves on an unreliable network.
+type SimNetwork struct {
+	Latency       time.Duration // delay of every message
+	Jitter        time.Duration // random extra delay of up to Jitter added to every message
+	LossRate      float64       // probability that a message is dropped
+	DuplicateRate float64       // probability that a message is delivered twice
+	ReorderRate   float64       // probability that a message is held back so it arrives after later messages
+	stats         SimStats
+	nodes         map[string]*Network // map of address : node
+	rand          *rand.Rand
+	lock          sync.Mutex
+}
+
+// SimStats counts what happened to the messages sent through a SimNetwork
+type SimStats struct {
+	Sent       int
+	Delivered  int
+	Dropped    int
+	Duplicated int
+	Reordered  int
+}
+
+// messenger used by the nodes of a SimNetwork, makes sure the sender field is always the node
+type simMessenger struct {
+	sim *SimNetwork
+	Rt  ContactTable
+}
+
+// NewSimNetwork returns a new instance of a SimNetwork, the seed makes runs reproducible
+func NewSimNetwork(seed int64) *SimNetwork {
+	return &SimNetwork{
+		nodes: make(map[string]*Network),
+		rand:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// AddNode creates a new Kademlia node with the default configuration that communicates through the SimNetwork
+func (sim *SimNetwork) AddNode(me Contact) *Kademlia {
+	kademlia, _ := sim.AddNodeWithConfig(me, Config{}) // the defaults are always valid
+	return kademlia
+}
+
+// AddNodeWithConfig creates a new Kademlia node with the parameters of config that communicates through the SimNetwork
+func (sim *SimNetwork) AddNodeWithConfig(me Contact, config Config) (*Kademlia, error) {
+	kademlia, err := NewKademlia(me, config)
+	if err != nil {
+		return nil, err
+	}
+	kademlia.Network.BootstrapIP = ""
+	sim.Attach(kademlia.Network)
+	return kademlia, nil
+}
+
+// Attach makes network send and receive messages through the SimNetwork at the address of its contact
+func (sim *SimNetwork) Attach(network *Network) {
+	network.Messenger = &simMessenger{sim: sim, Rt: network.Rt}
+
+	sim.lock.Lock()
+	sim.nodes[network.Rt.Me().Address] = network
+	sim.lock.Unlock()
+}
+
+// Remove the node at address, messages sent to it are lost from now on
+func (sim *SimNetwork) Remove(address string) {
+	sim.lock.Lock()
+	delete(sim.nodes, address)
+	sim.lock.Unlock()
+}
+
+// Stats returns a copy of the message statistics
+func (sim *SimNetwork) Stats() SimStats {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	return sim.stats
+}
+
+// SendMessage delivers msg to the node at the address of contact as configured
+func (sim *SimNetwork) SendMessage(contact *Contact, msg Message) {
+	sim.lock.Lock()
+	sim.stats.Sent++
+
+	target := sim.nodes[contact.Address]
+	if target == nil || sim.rand.Float64() < sim.LossRate { // nobody there or lost on the way
+		sim.stats.Dropped++
+		sim.lock.Unlock()
+		return
+	}
+
+	copies := 1
+	if sim.rand.Float64() < sim.DuplicateRate {
+		copies = 2
+		sim.stats.Duplicated++
+	}
+
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = sim.Latency
+		if sim.Jitter > 0 {
+			delays[i] += time.Duration(sim.rand.Int63n(int64(sim.Jitter)))
+		}
+		if sim.rand.Float64() < sim.ReorderRate { // hold back long enough for later messages to overtake it
+			delays[i] += 2*(sim.Latency+sim.Jitter) + time.Millisecond
+			sim.stats.Reordered++
+		}
+	}
+	sim.lock.Unlock()
+
+	for _, delay := range delays {
+		go sim.deliver(target, copyMessage(msg), delay)
+	}
+}
+
+// hand msg to the target after delay
+func (sim *SimNetwork) deliver(target *Network, msg Message, delay time.Duration) {
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	sim.lock.Lock()
+	sim.stats.Delivered++
+	sim.lock.Unlock()
+
+	target.MessageHandler(msg)
+}
+
+// send generic message through the SimNetwork
+func (m *simMessenger) SendMessage(contact *Contact, msg Message) {
+	log.Println("Sending simulated message: ", msg.MsgType)
+	// make sure the sender field is always this node
+	msg.Sender = m.Rt.Me()
+	m.sim.SendMessage(contact, msg)
+}
+
+// copy msg so the receiver can not modify the contacts of the sender
+func copyMessage(msg Message) Message {
+	msg.Contacts = append([]Contact(nil), msg.Contacts...)
+	return msg
+}
@@ -0,0 +1,204 @@
+package kademlia
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// create a simulated network of size nodes that have all joined through the first node
+func newSimCluster(t *testing.T, sim *SimNetwork, size int) []*Kademlia {
+	return newSimClusterWithConfig(t, sim, size, Config{})
+}
+
+// create a simulated network of size nodes with the parameters of config
+func newSimClusterWithConfig(t *testing.T, sim *SimNetwork, size int, config Config) []*Kademlia {
+	nodes := make([]*Kademlia, size)
+	for i := range nodes {
+		me := NewContact(NewRandomKademliaID(), fmt.Sprintf("node-%d", i))
+		node, err := sim.AddNodeWithConfig(me, config)
+		if err != nil {
+			t.Fatalf("Could not create node: %s", err)
+		}
+		nodes[i] = node
+		nodes[i].Network.ValuesDir = t.TempDir()
+		nodes[i].Network.BootstrapIP = nodes[0].Rt.Me().Address
+	}
+
+	for _, node := range nodes[1:] {
+		node.JoinNetwork()
+	}
+
+	return nodes
+}
+
+func TestSimNetworkPing(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.Latency = time.Millisecond
+
+	a := sim.AddNode(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "a"))
+	b := sim.AddNode(NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "b"))
+
+	out := make(chan Message)
+	go a.Network.SendPingMessage(contactOf(b), out)
+
+	if res := <-out; res.MsgType != "PONG" || *res.Sender.ID != *b.Rt.Me().ID {
+		t.Fatalf("The simulated ping was not answered by the right node! %s", res.MsgType)
+	}
+
+	// both nodes should now know about eachother
+	time.Sleep(10 * time.Millisecond)
+	if len(a.Rt.FindClosestContacts(b.Rt.Me().ID, 1)) != 1 || len(b.Rt.FindClosestContacts(a.Rt.Me().ID, 1)) != 1 {
+		t.Fatalf("The nodes did not add eachother to their routing tables!")
+	}
+}
+
+func TestSimNetworkUnreliable(t *testing.T) {
+	sim := NewSimNetwork(1)
+	a := sim.AddNode(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "a"))
+	b := sim.AddNode(NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "b"))
+
+	// test that every message is lost
+	sim.LossRate = 1
+	for i := 0; i < 10; i++ {
+		a.Network.Messenger.SendMessage(contactOf(b), Message{MsgType: "STORE_RESPONSE", RPCID: *NewRandomKademliaID()})
+	}
+	if stats := sim.Stats(); stats.Dropped != 10 || stats.Delivered != 0 {
+		t.Fatalf("All messages should have been dropped! %+v", stats)
+	}
+
+	// test that every message is delivered twice
+	sim.LossRate = 0
+	sim.DuplicateRate = 1
+	for i := 0; i < 10; i++ {
+		a.Network.Messenger.SendMessage(contactOf(b), Message{MsgType: "STORE_RESPONSE", RPCID: *NewRandomKademliaID()})
+	}
+	time.Sleep(10 * time.Millisecond)
+	if stats := sim.Stats(); stats.Duplicated != 10 || stats.Delivered != 20 {
+		t.Fatalf("All messages should have been delivered twice! %+v", stats)
+	}
+
+	// test that messages to unknown addresses are lost
+	sim.Remove("b")
+	a.Network.Messenger.SendMessage(contactOf(b), Message{MsgType: "STORE_RESPONSE"})
+	if stats := sim.Stats(); stats.Dropped != 11 {
+		t.Fatalf("A message to a removed node should have been dropped! %+v", stats)
+	}
+}
+
+func TestSimNetworkReorder(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.Latency = 10 * time.Millisecond // long enough that scheduling delays do not matter
+	a := sim.AddNode(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "a"))
+	b := sim.AddNode(NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "b"))
+
+	// b hands both responses to the same channel, in the order they arrive
+	held, next := *NewRandomKademliaID(), *NewRandomKademliaID()
+	arrived := make(chan Message, 2)
+	b.Network.lock.Lock()
+	b.Network.ExpectedResponses[held] = arrived
+	b.Network.ExpectedResponses[next] = arrived
+	b.Network.lock.Unlock()
+
+	sim.ReorderRate = 1
+	a.Network.Messenger.SendMessage(contactOf(b), Message{MsgType: "STORE_RESPONSE", RPCID: held})
+	sim.ReorderRate = 0
+	a.Network.Messenger.SendMessage(contactOf(b), Message{MsgType: "STORE_RESPONSE", RPCID: next})
+
+	// a held back message arrives later than the normal latency
+	time.Sleep(12 * time.Millisecond)
+	if stats := sim.Stats(); stats.Reordered != 1 || stats.Delivered != 1 {
+		t.Fatalf("Only the second message should have arrived! %+v", stats)
+	}
+
+	// test that the message sent later overtook the held back one
+	for _, expected := range []KademliaID{next, held} {
+		select {
+		case msg := <-arrived:
+			if msg.RPCID != expected {
+				t.Fatalf("The messages were not reordered! %s arrived instead of %s", msg.RPCID.String(), expected.String())
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("The held back message was never delivered! %+v", sim.Stats())
+		}
+	}
+}
+
+func TestSimNetworkLookup(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large simulated network in short mode")
+	}
+
+	// the same lookups with both designs of the routing table
+	t.Run("fixed", func(t *testing.T) { testSimNetworkLookup(t, Config{}) })
+	t.Run("tree", func(t *testing.T) { testSimNetworkLookup(t, Config{TreeTable: true}) })
+}
+
+func testSimNetworkLookup(t *testing.T, config Config) {
+	sim := NewSimNetwork(1)
+	sim.Latency = time.Millisecond
+	sim.Jitter = time.Millisecond
+	sim.DuplicateRate = 0.05
+	sim.ReorderRate = 0.1
+	nodes := newSimClusterWithConfig(t, sim, 200, config)
+
+	// test that a lookup finds the node closest to the target
+	target := NewRandomKademliaID()
+	all := make([]Contact, len(nodes)-1) // the node that looks up never finds itself
+	for i, node := range nodes[:len(nodes)-1] {
+		all[i] = node.Rt.Me()
+		all[i].CalcDistance(target)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Less(&all[j]) })
+
+	found := nodes[len(nodes)-1].LookupContact(*target)
+	if len(found) == 0 || *found[0].ID != *all[0].ID {
+		t.Fatalf("The lookup did not find the closest node! %v != %v", found, all[0].String())
+	}
+
+	// test that lookups find most of the k closest nodes, without flooding the network. The same bounds
+	// hold for both designs, so neither can get worse than the other unnoticed.
+	const lookups = 20
+	searcher := nodes[len(nodes)-1]
+	overlap, sent := 0, sim.Stats().Sent
+	for i := 0; i < lookups; i++ {
+		target := NewRandomKademliaID()
+		for j := range all {
+			all[j].CalcDistance(target)
+		}
+		sort.Slice(all, func(i, j int) bool { return all[i].Less(&all[j]) })
+
+		closest := make(map[KademliaID]bool)
+		for _, contact := range all[:searcher.Config.K] {
+			closest[*contact.ID] = true
+		}
+		for _, contact := range searcher.LookupContact(*target) {
+			if closest[*contact.ID] {
+				overlap++
+			}
+		}
+	}
+	share := float64(overlap) / float64(lookups*searcher.Config.K)
+	messages := float64(sim.Stats().Sent-sent) / lookups
+	if share < 0.9 {
+		t.Fatalf("The lookups only found %.0f%% of the k closest nodes!", 100*share)
+	}
+	if messages > 100 {
+		t.Fatalf("The lookups sent %.1f messages each!", messages)
+	}
+	t.Logf("%.0f%% of the k closest nodes found, %.1f messages per lookup", 100*share, messages)
+
+	// test that a value stored by one node can be found by another
+	data := []byte("stored in a simulated network")
+	err, hash := nodes[10].Store(data)
+	if err != nil {
+		t.Fatalf("Could not store the value: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond) // let the store messages arrive
+
+	if res := nodes[150].LookupData(hash); res != string(data) {
+		t.Fatalf("The stored value could not be found! %s", res)
+	}
+	t.Logf("%+v", sim.Stats()) // to compare the designs of the routing table
+}
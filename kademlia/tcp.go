@@ -0,0 +1,238 @@
+package kademlia
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// frames larger than this are rejected so a peer can not make us allocate unbounded memory. The
+// largest messages are the k contacts of a response and stored values, which are far smaller.
+const maxFrameSize = 1024 * 1024
+
+// connections served at the same time, more are closed right after they are accepted
+const maxTCPConns = 128
+
+// cached connections that have not been used for this long are closed and dialed again
+const tcpIdleTimeout = 1 * time.Minute
+
+// TCPMessenger sends messages over TCP. Every message is written as a frame consisting of
+// a 4 byte big endian length followed by the encoded message. Connections are kept open
+// and reused for later messages to the same address.
+type TCPMessenger struct {
+	Rt       ContactTable
+	Codec    Codec               // wire format of sent messages, defaults to BinaryCodec
+	Identity *Identity           // signs every sent message if set
+	Prefer   AddressPreference   // family that is dialed when a contact has addresses in both
+	Timeout  time.Duration       // how long connecting may take, DefaultTimeout if 0
+	conns    map[string]*tcpConn // map of address : cached connection
+	lock     sync.Mutex
+}
+
+// a cached outgoing connection, the lock makes sure frames are not interleaved
+type tcpConn struct {
+	conn     net.Conn
+	lastUsed time.Time
+	lock     sync.Mutex
+}
+
+// send generic message over TCP
+func (m *TCPMessenger) SendMessage(contact *Contact, msg Message) {
+	log.Println("Sending message over TCP: ", msg.MsgType)
+	// make sure the sender field is always this node
+	msg.Sender = m.Rt.Me()
+
+	if m.Identity != nil { // sign the message so the receiver knows it is really from us
+		if err := m.Identity.Sign(&msg); err != nil {
+			log.Println("SIGNATURE ERROR:", err)
+			return
+		}
+	}
+
+	data, err := codecOrDefault(m.Codec).Encode(msg) // encode
+	if err != nil {
+		log.Println("ENCODE ERROR:", err)
+		return
+	}
+
+	address, err := contact.DialAddress(m.Prefer)
+	if err != nil {
+		log.Println("TCP ERROR:", err)
+		return
+	}
+	if err := m.send(address, data); err != nil {
+		log.Println("TCP ERROR:", err)
+	}
+}
+
+// send an already encoded message to address, reusing a cached connection when possible
+func (m *TCPMessenger) send(address string, data []byte) error {
+	m.lock.Lock()
+	if m.conns == nil {
+		m.conns = make(map[string]*tcpConn)
+	}
+	c := m.conns[address]
+	if c == nil {
+		c = &tcpConn{}
+		m.conns[address] = c
+	}
+	m.lock.Unlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// the receiver closes idle connections, so do not trust a connection that has been idle for long
+	if c.conn != nil && time.Since(c.lastUsed) > tcpIdleTimeout {
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	// a cached connection may have been closed by the other side, so redial once on failure
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if c.conn == nil {
+			c.conn, err = net.DialTimeout("tcp", address, m.dialTimeout())
+			if err != nil {
+				return err
+			}
+		}
+
+		if err = writeFrame(c.conn, data); err == nil {
+			c.lastUsed = time.Now()
+			return nil
+		}
+
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	return err
+}
+
+// Close closes all cached connections
+func (m *TCPMessenger) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for address, c := range m.conns {
+		c.lock.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.lock.Unlock()
+		delete(m.conns, address)
+	}
+}
+
+// write data to w prefixed by its length
+func writeFrame(w io.Writer, data []byte) error {
+	if len(data) > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds the maximum of %d bytes", len(data), maxFrameSize)
+	}
+
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// read a single length prefixed frame from r
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+	if length > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the maximum of %d bytes", length, maxFrameSize)
+	}
+
+	// the buffer grows with the bytes that arrive, a peer that only sends the header costs nothing
+	var data bytes.Buffer
+	if n, err := data.ReadFrom(io.LimitReader(r, int64(length))); err != nil {
+		return nil, err
+	} else if n < int64(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return data.Bytes(), nil
+}
+
+// accept connections from listener until it is closed
+func (network *Network) acceptTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("TCP ACCEPT ERROR:", err)
+			}
+			return
+		}
+
+		network.lock.Lock()
+		if network.closed { // accepted while Close ran, which has closed the other connections already
+			network.lock.Unlock()
+			conn.Close()
+			return
+		}
+		if len(network.tcpConns) >= maxTCPConns {
+			network.lock.Unlock()
+			log.Println("TCP ERROR: too many connections, closing the one from", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		if network.tcpConns == nil {
+			network.tcpConns = make(map[net.Conn]bool)
+		}
+		network.tcpConns[conn] = true // closed by Close
+		network.serving.Add(1)        // Close waits until the connection is no longer served
+		network.lock.Unlock()
+
+		go network.serveTCP(conn)
+	}
+}
+
+// read frames from conn until the connection is closed or has been idle for too long
+func (network *Network) serveTCP(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		network.lock.Lock()
+		delete(network.tcpConns, conn)
+		network.lock.Unlock()
+		network.serving.Done()
+	}()
+
+	ip := conn.RemoteAddr().(*net.TCPAddr).IP
+	network.markVerified(ip.String()) // the TCP handshake proves the source receives our packets
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * tcpIdleTimeout))
+
+		data, err := readFrame(conn)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Println("TCP READ ERROR:", err)
+			}
+			return
+		}
+
+		network.handlePacket(data, ip)
+	}
+}
+
+// how long connecting may take
+func (m *TCPMessenger) dialTimeout() time.Duration {
+	if m.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return m.Timeout
+}
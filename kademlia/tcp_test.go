@@ -0,0 +1,215 @@
+package kademlia
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrame(t *testing.T) {
+	var buf bytes.Buffer
+	data := []byte("this is a framed message")
+
+	if err := writeFrame(&buf, data); err != nil {
+		t.Fatalf("Could not write frame: %s", err)
+	}
+	if buf.Len() != len(data)+4 {
+		t.Fatalf("The frame should be 4 bytes longer than the data! %d != %d", buf.Len(), len(data)+4)
+	}
+
+	res, err := readFrame(&buf)
+	if err != nil || string(res) != string(data) {
+		t.Fatalf("The frame could not be read back! %q %s", res, err)
+	}
+
+	// test that a frame claiming to be too big is rejected
+	_, err = readFrame(bytes.NewReader([]byte{0xFF, 0xFF, 0xFF, 0xFF}))
+	if err == nil {
+		t.Fatalf("A frame larger than the maximum frame size should be rejected!")
+	}
+
+	// test that a frame is only allocated as its bytes arrive
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = readFrame(bytes.NewReader([]byte{0x00, 0x10, 0x00, 0x00})) // 1 MiB is claimed, nothing follows
+	runtime.ReadMemStats(&after)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("A frame that ended early was not rejected! %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64*1024 {
+		t.Fatalf("The claimed length was allocated before the bytes arrived! %d bytes", allocated)
+	}
+}
+
+func TestTCPConnectionLimit(t *testing.T) {
+	k := newTestKademlia(t, NewContact(NewRandomKademliaID(), "127.0.0.1:0"))
+	if err := k.Start(); err != nil {
+		t.Fatalf("Could not start node: %s", err)
+	}
+	defer k.Close()
+
+	// the node serves as many connections as it can
+	k.Network.lock.Lock()
+	k.Network.tcpConns = make(map[net.Conn]bool)
+	for i := 0; i < maxTCPConns; i++ {
+		conn, _ := net.Pipe()
+		k.Network.tcpConns[conn] = true
+	}
+	k.Network.lock.Unlock()
+
+	// test that one more connection is closed right away
+	conn, err := net.Dial("tcp", "127.0.0.1:"+k.Network.ListenPort)
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("The connection over the limit was not closed! %v", err)
+	}
+}
+
+func TestTCPSendMessage(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var other = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "127.0.0.1:1235")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer listener.Close()
+	go n.acceptTCP(listener)
+
+	target := NewContact(me.ID, listener.Addr().String())
+	messenger := &TCPMessenger{Rt: NewRoutingTable(other)}
+	defer messenger.Close()
+
+	// a body that would never fit in a single UDP packet
+	body := strings.Repeat("a", 10*DefaultPacketSize)
+
+	for i := 0; i < 2; i++ {
+		id := *NewRandomKademliaID()
+		responseCh := make(chan Message)
+		n.lock.Lock()
+		n.ExpectedResponses[id] = responseCh
+		n.lock.Unlock()
+
+		messenger.SendMessage(&target, Message{MsgType: "PONG", RPCID: id, Body: body})
+
+		select {
+		case res := <-responseCh:
+			if res.Body != body || *res.Sender.ID != *other.ID {
+				t.Fatalf("The message received over TCP is not the one that was sent!")
+			}
+		case <-time.After(DefaultTimeout):
+			t.Fatalf("The message sent over TCP was never received!")
+		}
+	}
+
+	// test that the connection was reused for the second message
+	if len(messenger.conns) != 1 {
+		t.Fatalf("The TCP connection was not reused! There are %d cached connections", len(messenger.conns))
+	}
+}
+
+func TestUDPMessengerFallsBackToTCP(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var other = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "127.0.0.1:1235")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer listener.Close()
+	go n.acceptTCP(listener)
+
+	otherRt := NewRoutingTable(other)
+	tcp := &TCPMessenger{Rt: otherRt}
+	defer tcp.Close()
+	messenger := &UDPMessenger{Rt: otherRt, PacketSize: 1024, TCP: tcp}
+
+	id := *NewRandomKademliaID()
+	responseCh := make(chan Message)
+	n.lock.Lock()
+	n.ExpectedResponses[id] = responseCh
+	n.lock.Unlock()
+
+	// nothing listens for UDP on the address, so the message can only arrive over TCP
+	target := NewContact(me.ID, listener.Addr().String())
+	body := strings.Repeat("b", 4096)
+	messenger.SendMessage(&target, Message{MsgType: "FIND_DATA_RESPONSE", RPCID: id, Body: body})
+
+	select {
+	case res := <-responseCh:
+		if res.Body != body {
+			t.Fatalf("The large message was not received in full!")
+		}
+	case <-time.After(DefaultTimeout):
+		t.Fatalf("The large message was not sent over TCP!")
+	}
+}
+
+func TestUDPOnly(t *testing.T) {
+	a, err := NewKademlia(NewContact(NewRandomKademliaID(), "127.0.0.1:0"), Config{UDPOnly: true})
+	if err != nil {
+		t.Fatalf("Could not create node: %s", err)
+	}
+	if err := a.Start(); err != nil {
+		t.Fatalf("Could not start node: %s", err)
+	}
+	defer a.Close()
+	b := newTestKademlia(t, NewContact(NewRandomKademliaID(), "127.0.0.1:0"))
+
+	// test that the node does not listen for TCP connections
+	if conn, err := net.Dial("tcp", "127.0.0.1:"+a.Network.ListenPort); err == nil {
+		conn.Close()
+		t.Fatalf("A node that only uses UDP accepted a TCP connection!")
+	}
+
+	id := *NewRandomKademliaID()
+	responseCh := make(chan Message)
+	a.Network.lock.Lock()
+	a.Network.ExpectedResponses[id] = responseCh
+	a.Network.lock.Unlock()
+
+	// test that a node that uses TCP sends fragments once it can not connect
+	target := NewContact(a.Rt.Me().ID, "127.0.0.1:"+a.Network.ListenPort)
+	body := strings.Repeat("u", 2*DefaultPacketSize)
+	b.Network.Messenger.SendMessage(&target, Message{MsgType: "FIND_DATA_RESPONSE", RPCID: id, Body: body})
+	defer b.Close()
+
+	select {
+	case res := <-responseCh:
+		if res.Body != body {
+			t.Fatalf("The large message was not received in full!")
+		}
+	case <-time.After(DefaultTimeout):
+		t.Fatalf("The large message was not sent as fragments after TCP failed!")
+	}
+}
@@ -0,0 +1,263 @@
+package kademlia
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// TreeRoutingTable is a routing table that starts with one bucket covering the whole ID space, and
+// splits buckets as in section 4.2 of the Kademlia paper. A bucket is split when it is full and
+// covers the ID of me, or when the new contact is among the k closest contacts to me. Unlike
+// RoutingTable it can hold more than k contacts that are near me, as long as they are the closest.
+type TreeRoutingTable struct {
+	tableBase
+	leaves    []*treeBucket  // the buckets, together they cover the whole ID space
+	lock      sync.Mutex     // protects the buckets
+	evictions sync.WaitGroup // pings of the oldest contacts of full buckets
+}
+
+// a bucket of the tree, it holds the contacts whose IDs start with the first depth bits of prefix
+type treeBucket struct {
+	*bucket
+	prefix KademliaID
+	depth  int
+}
+
+// NewTreeRoutingTable returns a new instance of a TreeRoutingTable that uses the K and Timeout of config
+func NewTreeRoutingTable(me Contact, config Config) *TreeRoutingTable {
+	tree := &TreeRoutingTable{tableBase: newTableBase(me, config)}
+	tree.leaves = []*treeBucket{{bucket: newBucket(tree.k)}}
+	return tree
+}
+
+// AddContact adds contact to the bucket that covers its ID without waiting for the network. A full
+// bucket is split if the rules allow it, otherwise contact waits in the replacement cache while the
+// oldest contact of the bucket is pinged in the background, as in RoutingTable.AddContact.
+func (tree *TreeRoutingTable) AddContact(contact Contact, ping func(*Contact, chan Message)) {
+	tree.addContact(contact, ping, false)
+}
+
+// AddSender adds contact like AddContact, but a known contact takes the address of contact, as in RoutingTable.AddSender
+func (tree *TreeRoutingTable) AddSender(contact Contact, ping func(*Contact, chan Message)) {
+	tree.addContact(contact, ping, true)
+}
+
+// add contact, a known contact takes its address if moved
+func (tree *TreeRoutingTable) addContact(contact Contact, ping func(*Contact, chan Message), moved bool) {
+	if *contact.ID == *tree.me.ID {
+		return
+	} else if err := tree.Puzzle().Check(contact); err != nil {
+		log.Println("Not adding contact", contact.Address, err)
+		return
+	}
+
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	for {
+		i := tree.leafIndex(contact.ID)
+		leaf := tree.leaves[i]
+		if findElement(leaf.list, contact.ID) == nil && leaf.Len() >= tree.k && tree.canSplit(leaf, contact) {
+			tree.split(i)
+			continue
+		}
+
+		if oldest, full := leaf.insert(contact, moved); full && !leaf.checking { // one ping per bucket at a time
+			leaf.checking = true
+			tree.evictions.Add(1)
+			go tree.checkEviction(leaf, oldest, ping)
+		}
+		return
+	}
+}
+
+// ping the oldest contact of leaf without holding the lock, then apply the response. The leaf
+// may have been split in the meantime, then the response is applied to the bucket that covers
+// the oldest contact now.
+func (tree *TreeRoutingTable) checkEviction(leaf *treeBucket, oldest Contact, ping func(*Contact, chan Message)) {
+	defer tree.evictions.Done()
+
+	responseCh := make(chan Message)
+	go ping(&oldest, responseCh)
+	response := <-responseCh
+
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	leaf.checking = false
+	if tree.leaves[tree.leafIndex(oldest.ID)].checked(oldest, response) {
+		tree.forgetRTT(&oldest)
+	}
+}
+
+// ContactFailed replaces contact by the freshest candidate of the replacement cache of its bucket
+// after it failed to respond, as in RoutingTable.ContactFailed
+func (tree *TreeRoutingTable) ContactFailed(contact *Contact) {
+	if contact.ID == nil {
+		return
+	}
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	if candidate, ok := tree.leaves[tree.leafIndex(contact.ID)].replaceFailed(contact.ID); ok {
+		log.Println("Replaced failed contact", contact.Address, "with", candidate.Address)
+		tree.forgetRTT(contact)
+	}
+}
+
+// a full bucket may be split if it covers the ID of me, or if contact is among the k closest
+// contacts to me, which the paper relaxes the first rule with for unbalanced trees
+func (tree *TreeRoutingTable) canSplit(leaf *treeBucket, contact Contact) bool {
+	if leaf.depth >= IDLength*8 {
+		return false
+	}
+	if tree.me.ID.CommonPrefixLength(&leaf.prefix) >= leaf.depth {
+		return true
+	}
+
+	distance := contact.ID.CalcDistance(tree.me.ID)
+	closer := 0
+	for _, other := range tree.leaves {
+		for e := other.list.Front(); e != nil; e = e.Next() {
+			if e.Value.(Contact).ID.CalcDistance(tree.me.ID).Less(distance) {
+				closer++
+			}
+		}
+	}
+	return closer < tree.k
+}
+
+// replace the bucket at index i by two buckets that each cover half of its range
+func (tree *TreeRoutingTable) split(i int) {
+	leaf := tree.leaves[i]
+	low := &treeBucket{bucket: newBucket(tree.k), prefix: leaf.prefix, depth: leaf.depth + 1}
+	high := &treeBucket{bucket: newBucket(tree.k), prefix: leaf.prefix, depth: leaf.depth + 1}
+	high.prefix[leaf.depth/8] |= 0x80 >> (leaf.depth % 8)
+	low.lastLookup, high.lastLookup = leaf.lastLookup, leaf.lastLookup
+
+	// the contacts keep their order, the most recently seen first
+	for e := leaf.list.Front(); e != nil; e = e.Next() {
+		contact := e.Value.(Contact)
+		if high.covers(contact.ID) {
+			high.list.PushBack(contact)
+		} else {
+			low.list.PushBack(contact)
+		}
+	}
+	for e := leaf.replacements.Front(); e != nil; e = e.Next() {
+		contact := e.Value.(Contact)
+		if high.covers(contact.ID) {
+			high.replacements.PushBack(contact)
+		} else {
+			low.replacements.PushBack(contact)
+		}
+	}
+
+	tree.leaves = append(tree.leaves[:i], append([]*treeBucket{low, high}, tree.leaves[i+1:]...)...)
+}
+
+// covers reports whether id is in the range of the bucket
+func (leaf *treeBucket) covers(id *KademliaID) bool {
+	return id.CommonPrefixLength(&leaf.prefix) >= leaf.depth
+}
+
+// the index of the bucket that covers id
+func (tree *TreeRoutingTable) leafIndex(id *KademliaID) int {
+	for i, leaf := range tree.leaves {
+		if leaf.covers(id) {
+			return i
+		}
+	}
+	return -1 // the leaves always cover the whole ID space
+}
+
+// FindClosestContacts finds the count closest Contacts to the target in the TreeRoutingTable
+func (tree *TreeRoutingTable) FindClosestContacts(target *KademliaID, count int) []Contact {
+	return tree.FindClosestContactsExclude(target, count)
+}
+
+// FindClosestContactsExclude finds the count closest Contacts to the target in the TreeRoutingTable,
+// leaving out the contacts with an ID in exclude. The tree holds few buckets, so all contacts are sorted.
+func (tree *TreeRoutingTable) FindClosestContactsExclude(target *KademliaID, count int, exclude ...KademliaID) []Contact {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	excluded := make(map[KademliaID]bool, len(exclude))
+	for _, id := range exclude {
+		excluded[id] = true
+	}
+
+	var candidates ContactCandidates
+	for _, leaf := range tree.leaves {
+		for e := leaf.list.Front(); e != nil; e = e.Next() {
+			contact := e.Value.(Contact)
+			if !excluded[*contact.ID] {
+				contact.CalcDistance(target)
+				candidates.contacts = append(candidates.contacts, contact)
+			}
+		}
+	}
+	candidates.Sort()
+	return candidates.contacts[:max(min(count, len(candidates.contacts)), 0)]
+}
+
+// markLookup remembers that a lookup for target was started, so the bucket of its range is not stale
+func (tree *TreeRoutingTable) markLookup(target *KademliaID) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	tree.leaves[tree.leafIndex(target)].lastLookup = time.Now()
+}
+
+// StaleBuckets returns the indexes of the buckets that had no lookup in their range for interval.
+// The bucket that covers me is left out while it is empty, as in RoutingTable.StaleBuckets.
+func (tree *TreeRoutingTable) StaleBuckets(interval time.Duration) []int {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	var stale []int
+	for i, leaf := range tree.leaves {
+		if leaf.Len() == 0 && leaf.covers(tree.me.ID) {
+			continue
+		}
+		if time.Since(leaf.lastLookup) >= interval {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// RandomIDInBucket returns a random ID in the range of the bucket at index in the list Buckets
+// returns. An index that is out of range gives a random ID anywhere.
+func (tree *TreeRoutingTable) RandomIDInBucket(index int) *KademliaID {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	id := NewRandomKademliaID()
+	if index < 0 || index >= len(tree.leaves) { // the tree was split since the index was taken
+		return id
+	}
+	leaf := tree.leaves[index]
+	for i := 0; i < leaf.depth; i++ { // the bits of the prefix of the bucket
+		bit := byte(0x80) >> (i % 8)
+		id[i/8] = id[i/8]&^bit | leaf.prefix[i/8]&bit
+	}
+	return id
+}
+
+// Buckets returns a snapshot of every bucket of the tree, ordered by their ranges.
+// The Index of a bucket is the number of leading bits of its range.
+func (tree *TreeRoutingTable) Buckets() []BucketInfo {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	buckets := make([]BucketInfo, len(tree.leaves))
+	for i, leaf := range tree.leaves {
+		buckets[i] = BucketInfo{
+			Index:        leaf.depth,
+			Contacts:     listContacts(leaf.list),
+			Replacements: listContacts(leaf.replacements),
+			LastLookup:   leaf.lastLookup,
+		}
+	}
+	return buckets
+}
@@ -0,0 +1,151 @@
+package kademlia
+
+import (
+	"sort"
+	"testing"
+)
+
+// the count closest of contacts to target, found by sorting all of them
+func bruteForceClosest(contacts []Contact, target *KademliaID, count int) []Contact {
+	sorted := make([]Contact, len(contacts))
+	for i, contact := range contacts {
+		sorted[i] = contact
+		sorted[i].CalcDistance(target)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Less(&sorted[j]) })
+	return sorted[:min(count, len(sorted))]
+}
+
+// number of contacts in found that are also in expected
+func overlap(found []Contact, expected []Contact) int {
+	ids := map[KademliaID]bool{}
+	for _, contact := range expected {
+		ids[*contact.ID] = true
+	}
+	matches := 0
+	for _, contact := range found {
+		if ids[*contact.ID] {
+			matches++
+		}
+	}
+	return matches
+}
+
+func TestTreeRoutingTableSplit(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewRandomKademliaID(), "localhost:8000")
+	var tree = NewTreeRoutingTable(me, Config{K: 4})
+	/*-----------------------------------------------------------------------------------------------*/
+
+	if buckets := tree.Buckets(); len(buckets) != 1 || buckets[0].Index != 0 {
+		t.Fatalf("The tree does not start with one bucket! %v", buckets)
+	}
+
+	for i := 0; i < 500; i++ {
+		tree.AddContact(NewContact(NewRandomKademliaID(), "localhost:8001"), pingTest)
+	}
+	tree.evictions.Wait()
+
+	// test that the buckets cover the whole ID space without overlapping, and hold k contacts at most
+	var covered float64
+	containsMe := 0
+	for _, leaf := range tree.leaves {
+		covered += 1 / float64(uint64(1)<<min(leaf.depth, 63))
+		if leaf.covers(me.ID) {
+			containsMe++
+		}
+		if leaf.Len() > 4 {
+			t.Fatalf("A bucket holds more than k contacts! %d", leaf.Len())
+		}
+		for _, contact := range listContacts(leaf.list) {
+			if !leaf.covers(contact.ID) {
+				t.Fatalf("The contact %s is in a bucket that does not cover it!", contact.ID)
+			}
+		}
+	}
+	if covered != 1 || containsMe != 1 {
+		t.Fatalf("The buckets do not cover the ID space! %f %d", covered, containsMe)
+	}
+
+	// test that only the buckets near me were split
+	if depth := tree.leaves[tree.leafIndex(me.ID)].depth; len(tree.leaves) > 2*depth+2 {
+		t.Fatalf("Buckets far from me were split! %d buckets, me at depth %d", len(tree.leaves), depth)
+	}
+}
+
+func TestTreeRoutingTableKeepsClosest(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "localhost:8000")
+	var tables = map[string]ContactTable{
+		"fixed": NewRoutingTableWithConfig(me, Config{K: 4}),
+		"tree":  NewTreeRoutingTable(me, Config{K: 4}),
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	// contacts that are all in the same bucket of the fixed table, added from the farthest to the closest
+	var contacts []Contact
+	for i := 0; i < 40; i++ {
+		contact := NewContact(NewRandomKademliaIDWithPrefix(me.ID, 20), "localhost:8001")
+		contacts = append(contacts, contact)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[j].ID.CalcDistance(me.ID).Less(contacts[i].ID.CalcDistance(me.ID))
+	})
+	for _, table := range tables {
+		for _, contact := range contacts {
+			table.AddContact(contact, pingTest)
+		}
+	}
+	tables["fixed"].(*RoutingTable).evictions.Wait()
+	tables["tree"].(*TreeRoutingTable).evictions.Wait()
+
+	// test that the tree keeps the k closest contacts to me, where the fixed table keeps the first ones
+	expected := bruteForceClosest(contacts, me.ID, 4)
+	if found := tables["tree"].FindClosestContacts(me.ID, 4); overlap(found, expected) != 4 {
+		t.Fatalf("The tree did not keep the closest contacts! %v != %v", found, expected)
+	}
+	if found := tables["fixed"].FindClosestContacts(me.ID, 4); overlap(found, expected) == 4 {
+		t.Fatalf("The fixed table kept the closest contacts, the test does not compare anything!")
+	}
+
+	// test that random lookups are at least as good with the tree
+	var matches = map[string]int{}
+	for i := 0; i < 50; i++ {
+		target := NewRandomKademliaIDWithPrefix(me.ID, 20)
+		expected := bruteForceClosest(contacts, target, 4)
+		for name, table := range tables {
+			matches[name] += overlap(table.FindClosestContacts(target, 4), expected)
+		}
+	}
+	if matches["tree"] < matches["fixed"] {
+		t.Fatalf("The tree found fewer of the closest contacts than the fixed table! %v", matches)
+	}
+}
+
+func TestTreeRoutingTableEvictionAfterSplit(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "localhost:8000")
+	var tree = NewTreeRoutingTable(me, Config{K: 2})
+	var oldest = NewContact(NewKademliaID("0000000000000000000000000000000000000001"), "localhost:8001")
+	var candidate = NewContact(NewKademliaID("0000000000000000000000000000000000000003"), "localhost:8003")
+	/*-----------------------------------------------------------------------------------------------*/
+
+	tree.AddContact(oldest, pingTest)
+	tree.AddContact(NewContact(NewKademliaID("0000000000000000000000000000000000000002"), "localhost:8002"), pingTest)
+	leaf := tree.leaves[0]
+	leaf.addReplacement(candidate, false)
+
+	// the bucket is split while its oldest contact is pinged, the ping gets no response
+	tree.split(0)
+	tree.evictions.Add(1)
+	tree.checkEviction(leaf, oldest, pingTestTimeout)
+
+	// test that the contact that did not respond was replaced in the bucket that holds it now
+	found := tree.FindClosestContacts(oldest.ID, 2)
+	if overlap(found, []Contact{oldest}) != 0 || overlap(found, []Contact{candidate}) != 1 {
+		t.Fatalf("The failed contact was not replaced after the split! %v", found)
+	}
+}
@@ -0,0 +1,182 @@
+package kademlia
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// DefaultWorkers is the number of messages a Network without Workers handles at the same time
+const DefaultWorkers = 32
+
+// DefaultQueueSize is the number of messages of each kind a Network without QueueSize keeps
+// waiting for a worker, later messages are dropped until the workers catch up
+const DefaultQueueSize = 1024
+
+// QueueStats describes how busy the message handling of a network is, to help sizing Workers and QueueSize
+type QueueStats struct {
+	Workers   int // goroutines handling messages
+	Busy      int // workers that are handling a message right now
+	Capacity  int // size of each queue
+	Requests  int // requests waiting for a worker
+	Responses int // responses waiting for a worker, they are handled before any request
+	Contacts  int // senders waiting to be added to the routing table
+}
+
+// the queues of a running network, replaced when the network is started again
+type workQueues struct {
+	requests  chan Message
+	responses chan Message
+	contacts  chan Contact
+	busy      atomic.Int32
+}
+
+// isResponse reports whether msgType answers a request of this node
+func isResponse(msgType string) bool {
+	switch msgType {
+	case "PONG", "FIND_CONTACT_RESPONSE", "FIND_DATA_RESPONSE", "STORE_RESPONSE", "HANDSHAKE_RESPONSE":
+		return true
+	}
+	return false
+}
+
+// get the queues of the network, the workers are started together with them.
+// Returns nil once the network is closed.
+func (network *Network) workQueues() *workQueues {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	if network.closed {
+		return nil
+	}
+	if network.queues != nil {
+		return network.queues
+	}
+
+	size := network.QueueSize
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	workers := network.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if network.done == nil {
+		network.done = make(chan struct{})
+	}
+	done := network.done // read under the lock, Start replaces it after a Close
+
+	queues := &workQueues{
+		requests:  make(chan Message, size),
+		responses: make(chan Message, size),
+		contacts:  make(chan Contact, size),
+	}
+	network.queues = queues
+
+	network.serving.Add(workers + 1)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer network.serving.Done()
+			network.work(queues, done)
+		}()
+	}
+	go func() {
+		defer network.serving.Done()
+		network.updateContacts(queues, done)
+	}()
+	return queues
+}
+
+// handle messages until done is closed, responses are always taken before requests so a flood
+// of requests can not make the requests of this node time out
+func (network *Network) work(queues *workQueues, done <-chan struct{}) {
+	for {
+		var msg Message
+		select {
+		case msg = <-queues.responses:
+		default:
+			select {
+			case msg = <-queues.responses:
+			case msg = <-queues.requests:
+			case <-done:
+				return
+			}
+		}
+
+		queues.busy.Add(1)
+		network.MessageHandler(msg)
+		queues.busy.Add(-1)
+	}
+}
+
+// add senders to the routing table until done is closed. Adding a contact to a full bucket pings the
+// oldest contact of the bucket, which is done here so the workers do not wait for it.
+func (network *Network) updateContacts(queues *workQueues, done <-chan struct{}) {
+	for {
+		select {
+		case contact := <-queues.contacts:
+			if network.isVerified(sourceOf(contact.Address)) { // it answered our packets, so it may have moved there
+				network.Rt.AddSender(contact, network.SendPingMessage)
+			} else {
+				network.Rt.AddContact(contact, network.SendPingMessage)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// queue msg for the workers, false if its queue is full or the network is closed
+func (network *Network) enqueue(msg Message) bool {
+	queues := network.workQueues()
+	if queues == nil {
+		return false
+	}
+
+	queue := queues.requests
+	if isResponse(msg.MsgType) {
+		queue = queues.responses
+	}
+	select {
+	case queue <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// queue the sender of a handled message to be added to the routing table
+func (network *Network) queueContact(contact Contact) {
+	queues := network.workQueues()
+	if queues == nil {
+		return
+	}
+
+	select {
+	case queues.contacts <- contact:
+	default:
+		log.Println("Not adding contact", contact.Address, "the queue is full")
+		network.countDropped(dropQueueFull)
+	}
+}
+
+// QueueStats returns how many messages are waiting and how many workers are busy
+func (network *Network) QueueStats() QueueStats {
+	network.lock.Lock()
+	queues := network.queues
+	stats := QueueStats{Workers: network.Workers, Capacity: network.QueueSize}
+	network.lock.Unlock()
+
+	if stats.Workers <= 0 {
+		stats.Workers = DefaultWorkers
+	}
+	if stats.Capacity <= 0 {
+		stats.Capacity = DefaultQueueSize
+	}
+	if queues != nil {
+		stats.Busy = int(queues.busy.Load())
+		stats.Requests = len(queues.requests)
+		stats.Responses = len(queues.responses)
+		stats.Contacts = len(queues.contacts)
+	}
+	return stats
+}
@@ -0,0 +1,172 @@
+package kademlia
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a messenger that sends one message for every token it is given
+type blockingMessenger struct {
+	tokens chan struct{}
+	sent   int
+	lock   sync.Mutex
+}
+
+func (m *blockingMessenger) SendMessage(_ *Contact, _ Message) {
+	<-m.tokens
+	m.lock.Lock()
+	m.sent++
+	m.lock.Unlock()
+}
+
+func (m *blockingMessenger) Sent() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.sent
+}
+
+// wait until the workers of n are busy with busy messages
+func waitBusy(t *testing.T, n *Network, busy int) {
+	for i := 0; n.QueueStats().Busy != busy; i++ {
+		if i == 100 {
+			t.Fatalf("The workers did not pick up the messages! %+v", n.QueueStats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkerQueue(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var rt = NewRoutingTable(me)
+	var messenger = &blockingMessenger{tokens: make(chan struct{}, 10)}
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         messenger,
+		Workers:           1,
+		QueueSize:         1,
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+	defer n.Close()
+
+	source := net.IPv4(127, 0, 0, 2)
+	ping, _ := BinaryCodec{}.Encode(Message{MsgType: "PING", Sender: me})
+
+	// the only worker is stuck sending a PONG, and the queue holds one more request
+	n.handlePacket(ping, source)
+	waitBusy(t, &n, 1)
+	n.handlePacket(ping, source)
+	n.handlePacket(ping, source)
+	if dropped := n.DroppedPackets(); dropped[dropQueueFull] != 1 {
+		t.Fatalf("The request was not dropped when the queue was full! %v", dropped)
+	}
+
+	// test that a response still gets its own queue, and is handled before the waiting request
+	id := *NewRandomKademliaID()
+	responseCh := make(chan Message, 1)
+	n.lock.Lock()
+	n.ExpectedResponses[id] = responseCh
+	n.lock.Unlock()
+	pong, _ := BinaryCodec{}.Encode(Message{MsgType: "PONG", Sender: me, RPCID: id})
+	n.handlePacket(pong, source)
+
+	if stats := n.QueueStats(); stats.Requests != 1 || stats.Responses != 1 || stats.Workers != 1 || stats.Capacity != 1 {
+		t.Fatalf("The queue stats are wrong! %+v", stats)
+	}
+
+	messenger.tokens <- struct{}{} // let the first PONG go
+	select {
+	case <-responseCh:
+	case <-time.After(time.Second):
+		t.Fatalf("The response was not handled before the waiting request!")
+	}
+	if messenger.Sent() != 1 {
+		t.Fatalf("The waiting request was handled before the response!")
+	}
+
+	messenger.tokens <- struct{}{} // let the second PONG go
+	waitBusy(t, &n, 0)
+	if messenger.Sent() != 2 {
+		t.Fatalf("The waiting request was not handled!")
+	}
+}
+
+func TestWorkersStopOnClose(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+		Workers:           4,
+	}
+	/*-----------------------------------------------------------------------------------------------*/
+
+	if !n.enqueue(Message{MsgType: "PING", Sender: me}) {
+		t.Fatalf("The message was not queued!")
+	}
+
+	// test that Close waits for the workers, and that a closed network does not take messages
+	done := make(chan struct{})
+	go func() {
+		n.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Close did not stop the workers!")
+	}
+	if n.enqueue(Message{MsgType: "PING", Sender: me}) {
+		t.Fatalf("A closed network queued a message!")
+	}
+}
+
+func TestSenderMovesFromVerifiedSource(t *testing.T) {
+	// environment for test, set locally so tests don't affect eachother
+	/*-----------------------------------------------------------------------------------------------*/
+	var me = NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:1234")
+	var rt = NewRoutingTable(me)
+	var n = Network{
+		ListenPort:        "1234",
+		PacketSize:        1024,
+		ExpectedResponses: make(map[KademliaID]chan Message, 10),
+		Rt:                rt,
+		Messenger:         &MockMessenger{Rt: rt},
+	}
+	var spoofed = NewContact(NewKademliaID("1FFFFFFF00000000000000000000000000000000"), "127.0.0.2:1234")
+	var moved = NewContact(NewKademliaID("2FFFFFFF00000000000000000000000000000000"), "127.0.0.3:1234")
+	/*-----------------------------------------------------------------------------------------------*/
+	defer n.Close()
+	rt.AddContact(spoofed, pingTest)
+	rt.AddContact(moved, pingTest)
+
+	// a message claims to come from a known contact at an address that never answered us, and a
+	// known contact sends a message from a new address that did
+	n.markVerified("127.0.0.5")
+	n.MessageHandler(Message{MsgType: "PING", RPCID: *NewRandomKademliaID(), Sender: NewContact(spoofed.ID, "127.0.0.4:1234")})
+	n.MessageHandler(Message{MsgType: "PING", RPCID: *NewRandomKademliaID(), Sender: NewContact(moved.ID, "127.0.0.5:1234")})
+
+	// test that only the contact at the verified address moved, the senders are added in order
+	for i := 0; ; i++ {
+		if closest := rt.FindClosestContacts(moved.ID, 1); closest[0].Address == "127.0.0.5:1234" {
+			break
+		} else if i == 100 {
+			t.Fatalf("The contact did not move to the verified address! %v", closest)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if closest := rt.FindClosestContacts(spoofed.ID, 1); closest[0].Address != spoofed.Address {
+		t.Fatalf("The contact moved to an unverified address! %v", closest)
+	}
+}
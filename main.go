@@ -8,34 +8,136 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"time"
 )
 
-var thisIP string = GetLocalIP().String()
-var rt *kademlia.RoutingTable = kademlia.NewRoutingTable(kademlia.NewContact(kademlia.NewRandomKademliaID(), thisIP))
-var network kademlia.Network = kademlia.Network{
-	ListenPort:        "1234",
-	PacketSize:        1024 * 4,
-	ExpectedResponses: make(map[kademlia.KademliaID]chan kademlia.Message, 10),
-	Rt:                rt,
-	BootstrapIP:       "172.26.0.2:1234",
-	Messenger:         &kademlia.UDPMessenger{Rt: rt},
+var thisIP string = kademlia.LocalIP().String() // corrected by what peers observe once the node is running
+var puzzle kademlia.Puzzle = GetPuzzle()
+var config kademlia.Config = GetConfig()
+var k *kademlia.Kademlia = NewKademlia(NewIdentity(puzzle, config.DataDir), config)
+var network *kademlia.Network = k.Network
+
+func init() {
+	k.Rt.SetPuzzle(puzzle)
+
+	// advertise an address of the other family too on dual stack hosts
+	if ips := kademlia.LocalIPs(); len(ips) > 1 {
+		k.Rt.SetAddress(net.JoinHostPort(ips[1].String(), k.Config.ListenPort))
+	}
+
+	// ADDRESS_FAMILY picks the family that is dialed when a peer has both, IPv4 by default
+	if name := os.Getenv("ADDRESS_FAMILY"); name != "" {
+		preference, err := kademlia.ParseAddressPreference(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		network.SetAddressPreference(preference)
+	}
+
+	// messages are only encrypted if ENCRYPT=1, every node of the network has to set it
+	if os.Getenv("ENCRYPT") == "1" {
+		if err := network.EnableEncryption(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// NewIdentity generates the keypair of this node, its ID is derived from the public key and solves puzzle.
+// With a data directory the keypair is saved there, and a restarted node keeps its ID.
+func NewIdentity(puzzle kademlia.Puzzle, dataDir string) *kademlia.Identity {
+	var identity *kademlia.Identity
+	var err error
+	if dataDir != "" {
+		identity, err = kademlia.LoadOrCreateIdentity(dataDir, puzzle)
+	} else {
+		identity, err = kademlia.NewIdentityForPuzzle(puzzle)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return identity
 }
-var k kademlia.Kademlia = kademlia.Kademlia{&network, rt}
 
-func GetLocalIP() net.IP {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+// NewKademlia creates this node with the keypair identity, listening on the port of config
+func NewKademlia(identity *kademlia.Identity, config kademlia.Config) *kademlia.Kademlia {
+	port := config.ListenPort
+	if port == "" {
+		port = kademlia.DefaultListenPort
+	}
+	k, err := kademlia.NewKademliaWithIdentity(identity, net.JoinHostPort(thisIP, port), config)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer conn.Close()
+	return k
+}
 
-	localAddress := conn.LocalAddr().(*net.UDPAddr)
+// GetConfig reads the parameters of this node from K, ALPHA, REPUBLISH, REFRESH, TIMEOUT, BOOTSTRAP_IP,
+// LISTEN_PORT, PACKET_SIZE, DATA_DIR, SNAPSHOT, TREE_TABLE and UDP_ONLY, a missing variable means the default value
+func GetConfig() kademlia.Config {
+	config := kademlia.Config{
+		BootstrapIP: os.Getenv("BOOTSTRAP_IP"),
+		ListenPort:  os.Getenv("LISTEN_PORT"),
+		DataDir:     os.Getenv("DATA_DIR"),
+		TreeTable:   os.Getenv("TREE_TABLE") == "1", // buckets are split as in the Kademlia paper
+		UDPOnly:     os.Getenv("UDP_ONLY") == "1",   // for hosts where the TCP port can not be bound
+	}
+	for _, v := range []struct {
+		name  string
+		value *int
+	}{{"K", &config.K}, {"ALPHA", &config.Alpha}, {"PACKET_SIZE", &config.PacketSize}} {
+		value := os.Getenv(v.name)
+		if value == "" {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid %s: %s", v.name, err)
+		}
+		*v.value = number
+	}
+	for _, v := range []struct {
+		name     string
+		duration *time.Duration
+	}{{"REPUBLISH", &config.Republish}, {"REFRESH", &config.Refresh}, {"TIMEOUT", &config.Timeout}, {"SNAPSHOT", &config.Snapshot}} {
+		value := os.Getenv(v.name)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid %s: %s", v.name, err)
+		}
+		*v.duration = duration
+	}
+	return config
+}
 
-	return localAddress.IP
+// GetPuzzle reads the difficulty of the node ID puzzle of this deployment from
+// PUZZLE_STATIC and PUZZLE_DYNAMIC, a missing variable means no puzzle
+func GetPuzzle() kademlia.Puzzle {
+	var puzzle kademlia.Puzzle
+	for _, v := range []struct {
+		name string
+		bits *int
+	}{{"PUZZLE_STATIC", &puzzle.Static}, {"PUZZLE_DYNAMIC", &puzzle.Dynamic}} {
+		value := os.Getenv(v.name)
+		if value == "" {
+			continue
+		}
+		bits, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid %s: %s", v.name, err)
+		}
+		*v.bits = bits
+	}
+	return puzzle
 }
 
 func main() {
-	fmt.Println("This nodes IP: " + GetLocalIP().String())
+	fmt.Println("This nodes IP: " + thisIP)
+	go k.RefreshLoop() // buckets without lookups are refreshed in every mode
+	go k.SnapshotLoop()
 
 	arg := os.Args[1]
 	if arg == "listen" {
@@ -45,7 +147,7 @@ func main() {
 		go k.JoinNetwork()
 		network.Listen()
 	} else if arg == "cli" {
-		var cli = kademlia.NewCli(&k)
+		var cli = kademlia.NewCli(k)
 
 		go network.Listen()
 		go k.JoinNetwork()